@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Directory within an app holding its version aliases i.e.
+// <name>/.aliases/<alias> with the version as the value
+const aliasDir = ".aliases"
+
+func aliasPrefix(name string) string {
+	return name + "/" + aliasDir + "/"
+}
+
+// Aliases of an app mapped to the versions they point at
+func (ve *VolEtc) Aliases(name string) (map[string]string, error) {
+	m, err := ve.be.GetMap(aliasPrefix(name))
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]string{}
+	for k, v := range m {
+		if alias := strings.TrimPrefix(k, aliasPrefix(name)); alias != "" {
+			out[alias] = string(v)
+		}
+	}
+	return out, nil
+}
+
+// Point an alias e.g. latest or stable at an existing version of the app.
+// Aliases cannot look like versions i.e. start with a digit or v and a digit.
+func (ve *VolEtc) SetAlias(name, alias, version string) error {
+	if alias == "" || isVersionRange(alias) || looksLikeVersion(alias) || strings.ContainsAny(alias, "/@:") ||
+		strings.HasPrefix(alias, ".") || reservedVersions[alias] {
+		return fmt.Errorf("invalid alias: '%s'", alias)
+	}
+
+	if _, err := ve.versionTree(name, alias); err == nil {
+		return fmt.Errorf("alias is an existing version: '%s'", alias)
+	}
+	if _, err := ve.versionTree(name, version); err != nil {
+		return err
+	}
+	if err := ve.checkAliasLocks(name, alias); err != nil {
+		return err
+	}
+
+	return ve.be.SetMap(aliasPrefix(name), map[string][]byte{alias: []byte(version)})
+}
+
+func (ve *VolEtc) RemoveAlias(name, alias string) error {
+	aliases, err := ve.Aliases(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := aliases[alias]; !ok {
+		return fmt.Errorf("alias not found: '%s'", alias)
+	}
+	if err = ve.checkAliasLocks(name, alias); err != nil {
+		return err
+	}
+	return ve.be.DeleteKeys(aliasPrefix(name), []string{alias})
+}
+
+// Error if any env of the version the alias currently points at is locked as
+// changing the alias changes what the locked volume serves
+func (ve *VolEtc) checkAliasLocks(name, alias string) error {
+	aliases, err := ve.Aliases(name)
+	if err != nil {
+		return err
+	}
+	version, ok := aliases[alias]
+	if !ok {
+		return nil
+	}
+
+	vt, err := ve.versionTree(name, version)
+	if err != nil {
+		// target no longer exists
+		return nil
+	}
+	return ve.checkLocks(name, vt)
+}
+
+// Resolve a volume name whose version is an alias or a range e.g. 1.x or 1.2.*
+// to the name of the concrete volume.  Ranges resolve to the highest version
+// with the env.  Other names are returned as is.  An alias with the name of a
+// version created after it is an error rather than shadowing the version.
+func (ve *VolEtc) Resolve(n string) (string, error) {
+	name, version, env, err := parseAppName(n)
+	if err != nil {
+		return "", err
+	}
+
+	aliases, err := ve.Aliases(name)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := aliases[version]; ok {
+		if ve.be.KeyExists(name + "/" + version + "/") {
+			return "", fmt.Errorf("alias and version with the same name, remove the alias: '%s'", version)
+		}
+		return volumeNaming.Format(name, v, env), nil
+	}
+
+	if !isVersionRange(version) {
+		return n, nil
+	}
+
+	tree, err := ve.Tree(name)
+	if err != nil {
+		return "", err
+	}
+
+	best := ""
+	if len(tree) > 0 {
+		for _, vt := range tree[0].Versions {
+			i := sort.SearchStrings(vt.Envs, env)
+			if i == len(vt.Envs) || vt.Envs[i] != env || !matchVersionRange(version, vt.Version) {
+				continue
+			}
+			if best == "" || compareVersions(vt.Version, best) > 0 {
+				best = vt.Version
+			}
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("no version matching '%s': %s", version, n)
+	}
+	return volumeNaming.Format(name, best, env), nil
+}
+
+// Whether a name starts like a version e.g. 1.2.0 or v2
+func looksLikeVersion(v string) bool {
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "v"), "V")
+	return v != "" && v[0] >= '0' && v[0] <= '9'
+}
+
+// Ranges contain x or * in place of a version part e.g. 1.x, 1.2.* or x
+func isVersionRange(v string) bool {
+	for _, p := range strings.Split(v, ".") {
+		if p == "x" || p == "X" || p == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Match a version against a range.  Pre-releases e.g. 1.2.0-rc1 never match.
+func matchVersionRange(rng, v string) bool {
+	if strings.Contains(v, "-") {
+		return false
+	}
+
+	rp, vp := strings.Split(rng, "."), strings.Split(v, ".")
+	for i, p := range rp {
+		if p == "x" || p == "X" || p == "*" {
+			return true
+		}
+		if i >= len(vp) || p != vp[i] {
+			return false
+		}
+	}
+	return len(rp) == len(vp)
+}
+
+// Compare versions part by part numerically where possible
+func compareVersions(a, b string) int {
+	ap, bp := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aerr := strconv.Atoi(ap[i])
+		bn, berr := strconv.Atoi(bp[i])
+
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aerr != nil || berr != nil) && ap[i] != bp[i]:
+			if ap[i] < bp[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(ap) - len(bp)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_matchVersionRange(t *testing.T) {
+	for _, c := range []struct {
+		rng, v string
+		match  bool
+	}{
+		{"1.x", "1.2.3", true},
+		{"1.2.*", "1.2.3", true},
+		{"x", "0.1.0", true},
+		{"1.x", "2.0.0", false},
+		{"1.2.x", "1.20.0", false},
+		{"1.x", "1.2.0-rc1", false},
+	} {
+		if matchVersionRange(c.rng, c.v) != c.match {
+			t.Errorf("%s %s: should be %v", c.rng, c.v, c.match)
+		}
+	}
+
+	if compareVersions("1.10.0", "1.9.0") <= 0 || compareVersions("1.2", "1.2.1") >= 0 || compareVersions("1.2.0", "1.2.0") != 0 {
+		t.Error("wrong order")
+	}
+}
+
+func Test_VolEtc_Resolve(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("aliased")
+
+	for _, name := range []string{"aliased-1.2.0-prod", "aliased-1.10.0-prod", "aliased-1.11.0-dev", "aliased-2.0.0-prod"} {
+		ac, _ := NewAppConfigFromName(name, ve.be)
+		ac.Set(map[string][]byte{"db/host": []byte("127.0.0.1")})
+		if err := ac.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ve.SetAlias("aliased", "stable", "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ve.SetAlias("aliased", "latest", "3.0.0"); err == nil {
+		t.Error("should fail for missing version")
+	}
+	for _, alias := range []string{"1.10.0", "1.3.0", "v2"} {
+		if err := ve.SetAlias("aliased", alias, "1.2.0"); err == nil {
+			t.Errorf("%s: should fail for a version", alias)
+		}
+	}
+
+	for in, exp := range map[string]string{
+		"aliased-stable-prod": "aliased-1.2.0-prod",
+		"aliased-1.x-prod":    "aliased-1.10.0-prod",
+		"aliased-x-prod":      "aliased-2.0.0-prod",
+		"aliased-1.2.0-prod":  "aliased-1.2.0-prod",
+	} {
+		got, err := ve.Resolve(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+		} else if got != exp {
+			t.Errorf("%s: got %s", in, got)
+		}
+	}
+
+	if _, err := ve.Resolve("aliased-3.x-prod"); err == nil {
+		t.Error("should fail")
+	}
+
+	// aliases are not volumes
+	vols, err := ve.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) < 4 {
+		t.Errorf("volumes missing: %d", len(vols))
+	}
+
+	// a version created with the name of an alias is not shadowed
+	if err := ve.SetAlias("aliased", "edge", "2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	edge, _ := NewAppConfigFromName("aliased-edge-prod", ve.be)
+	edge.Set(map[string][]byte{"db/host": []byte("127.0.0.1")})
+	if err := edge.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ve.Resolve("aliased-edge-prod"); err == nil {
+		t.Errorf("should fail for alias and version with the same name: %s", got)
+	}
+
+	if err := ve.RemoveAlias("aliased", "stable"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ve.Resolve("aliased-stable-prod"); got != "aliased-stable-prod" {
+		t.Errorf("alias not removed: %s", got)
+	}
+}
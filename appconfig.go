@@ -1,14 +1,43 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
 	"strings"
+	"time"
 )
 
+// Key scopes in order of increasing precedence
+const (
+	ScopeApp     = "app"
+	ScopeVersion = "version"
+	ScopeEnv     = "env"
+)
+
+// Directory shared keys are stored under for the app and version scopes i.e.
+// <name>/shared/<key> and <name>/<version>/shared/<key>
+const sharedDir = "shared"
+
+// Directory within an env holding its metadata e.g. <env>/.meta/parent
+const metaDir = ".meta"
+
+// Directory within the env metadata holding its labels i.e.
+// <env>/.meta/labels/<label>
+const labelsDir = "labels"
+
+// Prefix of the app metadata in the format of Set i.e. .meta/app/owner.  It
+// is stored once per app under <name>/.meta/
+const appMetaDir = metaDir + "/" + ScopeApp
+
 var (
 	errInvalidConfName = fmt.Errorf("invalid name: <name>-<version>-<env>")
+
+	// Names used by the backend layout that cannot be used as a version or env
+	reservedVersions = map[string]bool{sharedDir: true}
+	reservedEnvs     = map[string]bool{"templates": true, "files": true, sharedDir: true}
 )
 
 type ConfigKeys map[string][]byte
@@ -29,14 +58,63 @@ type AppConfig struct {
 	Env     string
 	// Keys available to be applied to template
 	Keys ConfigKeys
+	// Keys shared by all versions of the app
+	AppKeys ConfigKeys `json:",omitempty"`
+	// Keys shared by all environments of the version
+	VersionKeys ConfigKeys `json:",omitempty"`
+	// Types of the keys of the version
+	Schema Schema `json:",omitempty"`
+	// Env keys are inherited from
+	Parent string `json:",omitempty"`
+	// Descriptive metadata of the volume
+	Owner       string            `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	// Descriptive metadata of the app shared by all of its volumes.  The
+	// metadata of the volume takes precedence.
+	AppOwner       string            `json:",omitempty"`
+	AppDescription string            `json:",omitempty"`
+	AppLabels      map[string]string `json:",omitempty"`
+	// Who locked the volume against changes
+	Locked   bool   `json:",omitempty"`
+	LockedBy string `json:",omitempty"`
+	// Keys of the parent chain closest parent first
+	inherited []keyScope
+	setParent bool
+	// The schema is only written when set explicitly so a commit from a stale
+	// copy doesn't revert it
+	setSchema  bool
+	setAppMeta bool
+	// Where changes originate from e.g. cli or docker and the message to
+	// record with the next revision
+	source      string
+	revisionMsg string
+	// Logger of the docker request the volume is loaded for if any
+	lg *Logger
+	// Snapshot of the data as last loaded from or committed to the backend
+	// used to audit changes
+	loaded  map[string][]byte
+	existed bool
+	// Backend keys removed from the in mem datastructure to be deleted on
+	// the next commit
+	removed map[string]bool
 	// Available templates
 	Templates []*Template
+	// Templates of the env overriding or adding to the version templates
+	EnvTemplates []*Template `json:",omitempty"`
 	// Backend consul, etcd ...
 	be Backend
 }
 
 func NewAppConfigFromName(name string, be Backend) (*AppConfig, error) {
-	a := &AppConfig{Templates: []*Template{}, Keys: ConfigKeys{}}
+	a := &AppConfig{
+		Templates:   []*Template{},
+		Keys:        ConfigKeys{},
+		AppKeys:     ConfigKeys{},
+		VersionKeys: ConfigKeys{},
+		Labels:      map[string]string{},
+		AppLabels:   map[string]string{},
+	}
 	var err error
 
 	if a.Name, a.Version, a.Env, err = parseAppName(name); err == nil {
@@ -48,21 +126,36 @@ func NewAppConfigFromName(name string, be Backend) (*AppConfig, error) {
 	return a, err
 }
 
+// Add a version template or an env override if the template has its Env set.
+// Templates and files share the same namespace in the volume so a template
+// and a file with the same name are an error.
 func (ac *AppConfig) AddTemplate(t *Template) error {
-	found := false
-	for _, v := range ac.Templates {
-		if v.Name == t.Name && v.Sha1 == t.Sha1 {
-			found = true
+	tmpls := &ac.Templates
+	if t.Env != "" {
+		tmpls = &ac.EnvTemplates
+	}
+
+	found := -1
+	for i, v := range *tmpls {
+		if v.Name == t.Name {
+			found = i
 		}
 	}
-	if !found {
+	if found >= 0 && (*tmpls)[found].Static != t.Static {
+		return fmt.Errorf("template and file with the same name: '%s'", t.Name)
+	}
+	if found < 0 || (*tmpls)[found].Sha1 != t.Sha1 {
 
 		keys, err := t.Keys()
 		if err != nil {
 			return err
 		}
 
-		ac.Templates = append(ac.Templates, t)
+		if found < 0 {
+			*tmpls = append(*tmpls, t)
+		} else {
+			(*tmpls)[found] = t
+		}
 		// add template keys
 		for k, _ := range keys {
 			if _, ok := ac.Keys[k]; !ok {
@@ -74,96 +167,645 @@ func (ac *AppConfig) AddTemplate(t *Template) error {
 	return nil
 }
 
+// Templates and files making up the volume.  Env overrides take the place of
+// version templates with the same name.
+func (ac *AppConfig) ActiveTemplates() []*Template {
+	out := make([]*Template, 0, len(ac.Templates)+len(ac.EnvTemplates))
+	for _, t := range ac.Templates {
+		if ac.envTemplate(t.Name) == nil {
+			out = append(out, t)
+		}
+	}
+	return append(out, ac.EnvTemplates...)
+}
+
+func (ac *AppConfig) envTemplate(name string) *Template {
+	for _, t := range ac.EnvTemplates {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// A set of keys and the scope they belong to
+type keyScope struct {
+	name string
+	keys ConfigKeys
+}
+
+// Key scopes in order of increasing precedence i.e. app, version, inherited
+// envs starting with the root of the chain and finally the env itself.
+func (ac *AppConfig) keyScopes() []keyScope {
+	out := []keyScope{{ScopeApp, ac.AppKeys}, {ScopeVersion, ac.VersionKeys}}
+	for i := len(ac.inherited) - 1; i >= 0; i-- {
+		out = append(out, ac.inherited[i])
+	}
+	return append(out, keyScope{ScopeEnv, ac.Keys})
+}
+
+// Merge the app, version, inherited and env keys where env takes precedence
+// over its parents, parents over version and version over app.  Keys without
+// a value do not override other scopes.  It returns the merged keys along with
+// the scope each value came from.
+func (ac *AppConfig) EffectiveKeys() (ConfigKeys, map[string]string) {
+	keys := ConfigKeys{}
+	scopes := map[string]string{}
+
+	for _, sc := range ac.keyScopes() {
+		for k, v := range sc.keys {
+			if _, ok := keys[k]; ok && len(v) == 0 {
+				continue
+			}
+			keys[k] = v
+			scopes[k] = sc.name
+		}
+	}
+
+	return keys, scopes
+}
+
+// Scopes with a value for each key ordered by decreasing precedence.  The
+// first is where the effective value comes from, the rest are overridden.
+func (ac *AppConfig) KeySources() map[string][]string {
+	out := map[string][]string{}
+	for _, sc := range ac.keyScopes() {
+		for k, v := range sc.keys {
+			if len(v) > 0 {
+				out[k] = append([]string{sc.name}, out[k]...)
+			}
+		}
+	}
+	return out
+}
+
+// Effective keys as strings to be applied to templates
+func (ac *AppConfig) renderKeys() map[string]string {
+	keys, _ := ac.EffectiveKeys()
+	return keys.ToString()
+}
+
 func (c *AppConfig) Exists() bool {
 	return c.be.KeyExists(c.getOpaque(c.Env))
 }
 
 func (c *AppConfig) Metadata() map[string]interface{} {
-	log.Println(c.Keys)
-	return map[string]interface{}{
+	keys, _ := c.EffectiveKeys()
+	md := map[string]interface{}{
 		"id":      c.QualifiedName(),
 		"name":    c.Name,
 		"version": c.Version,
 		"env":     c.Env,
-		"files":   len(c.Templates),
-		"keys":    len(c.Keys),
+		"files":   len(c.ActiveTemplates()),
+		"keys":    len(keys),
+	}
+
+	if owner := c.EffectiveOwner(); owner != "" {
+		md["owner"] = owner
+	}
+	if c.Description != "" {
+		md["description"] = c.Description
+	} else if c.AppDescription != "" {
+		md["description"] = c.AppDescription
+	}
+	if labels := c.EffectiveLabels(); len(labels) > 0 {
+		md["labels"] = labels
+	}
+	if c.Locked {
+		md["locked"] = true
+		md["locked_by"] = c.LockedBy
+	}
+	return md
+}
+
+// Owner of the volume falling back to the owner of the app
+func (c *AppConfig) EffectiveOwner() string {
+	if c.Owner != "" {
+		return c.Owner
+	}
+	return c.AppOwner
+}
+
+// Labels of the app overridden by the labels of the volume
+func (c *AppConfig) EffectiveLabels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range c.AppLabels {
+		labels[k] = v
+	}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Whether the volume or its app has all of the given labels
+func (c *AppConfig) HasLabels(labels map[string]string) bool {
+	el := c.EffectiveLabels()
+	for k, v := range labels {
+		if lv, ok := el[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Set the owner, description and labels from the env metadata
+func (c *AppConfig) setMetadata(meta map[string][]byte) {
+	for k, v := range meta {
+		switch {
+		case k == "owner":
+			c.Owner = string(v)
+		case k == "description":
+			c.Description = string(v)
+		case k == "locked":
+			c.Locked, c.LockedBy = true, string(v)
+		case strings.HasPrefix(k, labelsDir+"/"):
+			c.Labels[strings.TrimPrefix(k, labelsDir+"/")] = string(v)
+		}
 	}
 }
 
-// Load data from backedn
+// Set the owner, description and labels of the app from its metadata
+func (c *AppConfig) setAppMetadata(mm map[string][]byte) {
+	for key, v := range mm {
+		switch k := strings.TrimPrefix(key, c.appMetaOpaque()); {
+		case k == "owner":
+			c.AppOwner = string(v)
+		case k == "description":
+			c.AppDescription = string(v)
+		case strings.HasPrefix(k, labelsDir+"/"):
+			c.AppLabels[strings.TrimPrefix(k, labelsDir+"/")] = string(v)
+		}
+	}
+}
+
+// Load data from backedn i.e. templates, app, version and env keys
 func (a *AppConfig) Load() error {
 	gm, err := a.be.GetMap(a.getOpaque(""))
-	if err == nil {
-		a.Set(gm)
+	if err != nil {
+		return err
 	}
 
-	return err
+	am, err := a.be.GetMap(a.sharedOpaque())
+	if err != nil {
+		return err
+	}
+
+	mm, err := a.be.GetMap(a.appMetaOpaque())
+	if err != nil {
+		return err
+	}
+	if !a.setAppMeta {
+		a.setAppMetadata(mm)
+	}
+
+	for key, v := range gm {
+		k := strings.TrimPrefix(key, a.getOpaque(""))
+
+		switch {
+		case strings.HasPrefix(k, a.Env+"/templates/"), strings.HasPrefix(k, a.Env+"/files/"):
+			if t := NewTemplateFromKey(strings.TrimPrefix(k, a.Env+"/")); t != nil {
+				t.Env = a.Env
+				t.SetBody(v)
+				if err = a.AddTemplate(t); err != nil {
+					return err
+				}
+			}
+
+		case strings.HasPrefix(k, "templates/"), strings.HasPrefix(k, "files/"):
+			if t := NewTemplateFromKey(k); t != nil {
+				t.SetBody(v)
+				if err = a.AddTemplate(t); err != nil {
+					return err
+				}
+			}
+
+		case strings.HasPrefix(k, sharedDir+"/"):
+			a.VersionKeys[strings.TrimPrefix(k, sharedDir+"/")] = v
+
+		case k == schemaKey:
+			if a.Schema, err = ParseSchema(v); err != nil {
+				return err
+			}
+
+		}
+	}
+
+	var meta map[string][]byte
+	a.Keys, meta = a.envKeys(gm, a.Env, a.Keys)
+	if !a.setParent {
+		a.Parent = string(meta["parent"])
+	}
+	a.setMetadata(meta)
+
+	_, marker := gm[a.getOpaque(a.Env)]
+	a.existed = marker || len(a.Keys) > 0 || len(meta) > 0
+
+	if a.inherited, err = a.resolveParents(gm); err != nil {
+		return err
+	}
+
+	for key, v := range am {
+		if k := strings.TrimPrefix(key, a.sharedOpaque()); k != "" {
+			a.AppKeys[k] = v
+		}
+	}
+
+	a.loaded = a.snapshot()
+	return nil
+}
+
+// Split the keys of env in the version map into config keys and metadata.
+// Keys are added to keys if provided.
+func (a *AppConfig) envKeys(gm map[string][]byte, env string, keys ConfigKeys) (ConfigKeys, map[string][]byte) {
+	if keys == nil {
+		keys = ConfigKeys{}
+	}
+	meta := map[string][]byte{}
+
+	prefix := a.getOpaque(env + "/")
+	for key, v := range gm {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		k := strings.TrimPrefix(key, prefix)
+		switch {
+		case strings.HasPrefix(k, metaDir+"/"):
+			meta[strings.TrimPrefix(k, metaDir+"/")] = v
+		case strings.HasPrefix(k, "."):
+			// reserved for internal use
+		case strings.HasPrefix(k, "templates/"), strings.HasPrefix(k, "files/"):
+			// env template overrides are only applicable to the env itself
+			// and loaded by Load
+		case k != "":
+			keys[k] = v
+		}
+	}
+
+	return keys, meta
+}
+
+// Walk the parent chain starting with the parent of the env, loading the keys
+// of each parent from the version map.  Cycles and missing parents are errors.
+func (a *AppConfig) resolveParents(gm map[string][]byte) ([]keyScope, error) {
+	out := []keyScope{}
+	seen := map[string]bool{a.Env: true}
+	chain := a.Env
+
+	for parent := a.Parent; parent != ""; {
+		chain += " -> " + parent
+		if seen[parent] {
+			return nil, fmt.Errorf("inheritance cycle: %s", chain)
+		}
+		seen[parent] = true
+
+		keys, meta := a.envKeys(gm, parent, nil)
+		if _, ok := gm[a.getOpaque(parent)]; !ok && len(keys) == 0 && len(meta) == 0 {
+			return nil, fmt.Errorf("parent env not found: '%s'", parent)
+		}
+
+		out = append(out, keyScope{ScopeEnv + ":" + parent, keys})
+		parent = string(meta["parent"])
+	}
+
+	return out, nil
+}
+
+// Logger of the request the volume is loaded for falling back to the default
+func (a *AppConfig) log() *Logger {
+	if a.lg != nil {
+		return a.lg
+	}
+	return logger
 }
 
 func (a *AppConfig) QualifiedName() string {
-	return a.Name + "-" + a.Version + "-" + a.Env
+	return volumeNaming.Format(a.Name, a.Version, a.Env)
 }
 
-// Store in mem datastructure to backend
+// Store in mem datastructure to backend and record it as a new revision.  Only
+// the app and version scoped entries changed since the volume was loaded are
+// written and only if none of the envs sharing them is locked.
 func (a *AppConfig) Commit() error {
+	if err := a.checkLock(); err != nil {
+		return err
+	}
+
+	changed := a.changedKeys()
+	scopes := map[string]bool{}
+	for k := range changed {
+		scopes[a.keyScope(k)] = true
+	}
+	for _, scope := range []string{ScopeApp, ScopeVersion} {
+		if scopes[scope] {
+			if err := a.checkScopeLock(scope); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Make sure the parent chain is valid before storing it
+	if a.setParent {
+		gm, err := a.be.GetMap(a.getOpaque(""))
+		if err != nil {
+			return err
+		}
+		if _, err = a.resolveParents(gm); err != nil {
+			return err
+		}
+	}
+
+	if a.Schema != nil {
+		keys, _ := a.EffectiveKeys()
+		if err := a.Schema.Validate(keys); err != nil {
+			return err
+		}
+	}
+
+	am := map[string][]byte{}
+	for k, v := range a.AppKeys {
+		if changed[a.sharedOpaque()+k] {
+			am[k] = v
+		}
+	}
+	if len(am) > 0 {
+		if err := a.be.SetMap(a.sharedOpaque(), am); err != nil {
+			return err
+		}
+	}
+
+	// The app metadata is only written when set so a commit from a stale
+	// copy doesn't revert it
+	if a.setAppMeta {
+		if mm := a.buildAppMetaMap(); len(mm) > 0 {
+			if err := a.be.SetMap(a.appMetaOpaque(), mm); err != nil {
+				return err
+			}
+		}
+		a.setAppMeta = false
+	}
+
 	m := a.buildBackendDataMap()
+	for k := range m {
+		if a.keyScope(a.getOpaque(k)) == ScopeVersion && !changed[a.getOpaque(k)] {
+			delete(m, k)
+		}
+	}
 	// store to backend
-	return a.be.SetMap(a.getOpaque(""), m)
+	if err := a.be.SetMap(a.getOpaque(""), m); err != nil {
+		return err
+	}
+	a.setSchema = false
+
+	if len(a.removed) > 0 {
+		keys := make([]string, 0, len(a.removed))
+		for k := range a.removed {
+			keys = append(keys, k)
+		}
+		if err := a.be.DeleteKeys("", keys); err != nil {
+			return err
+		}
+		a.removed = nil
+	}
+
+	action := AuditEdit
+	switch {
+	case a.revisionMsg != "":
+		action = AuditRollback
+	case !a.existed:
+		action = AuditCreate
+	}
+	a.audit(action, a.snapshot())
+	a.existed = true
+
+	_, err := a.recordRevision(a.revisionMsg)
+	a.revisionMsg = ""
+	return err
 }
 
 // Load data from backend, generate directory structure and
 // rendered config files under `basedir`
 func (a *AppConfig) Generate(basedir string) error {
-	err := a.Load()
-	if err == nil {
-		keys := a.Keys.ToString()
-		for _, t := range a.Templates {
-			rendered, err := t.Render(keys)
-			if err == nil {
-				if err = ioutil.WriteFile(basedir+"/"+t.Name, rendered, 0644); err == nil {
-					continue
-				}
-			}
+	if err := a.Load(); err != nil {
+		return err
+	}
+	return a.WriteFiles(basedir)
+}
 
-			break
+// Render the in mem templates and write them along with static files under
+// `basedir`
+func (a *AppConfig) WriteFiles(basedir string) error {
+	keys := a.renderKeys()
+	for _, t := range a.ActiveTemplates() {
+		rendered, err := t.Render(keys)
+		if err == nil {
+			err = ioutil.WriteFile(basedir+"/"+t.Name, rendered, 0644)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
-	return err
+	return nil
 }
 
 func (a *AppConfig) cacheRender() {
-	keys := a.Keys.ToString()
-	for _, t := range a.Templates {
+	keys := a.renderKeys()
+	for _, t := range a.ActiveTemplates() {
 		if _, err := t.Render(keys); err != nil {
-			log.Println("ERR", err)
+			a.log().Error("render failed", "volume", a.QualifiedName(), "template", t.Name, "err", err)
 		}
 	}
 }
 
 // Destroy keys from the backend.
 func (a *AppConfig) Destroy() error {
-	return a.be.DeleteMap(a.getOpaque(a.Env + "/"))
+	if err := a.checkLock(); err != nil {
+		return err
+	}
+
+	if err := a.destroy(); err != nil {
+		return err
+	}
+
+	a.audit(AuditRemove, map[string][]byte{})
+	a.existed = false
+	return nil
+}
+
+// Delete the env keys along with the env marker
+func (a *AppConfig) destroy() error {
+	if err := a.be.DeleteMap(a.getOpaque(a.Env + "/")); err != nil {
+		return err
+	}
+	return a.be.DeleteKeys(a.getOpaque(""), []string{a.Env})
 }
 
-// Set input data to  datastructure.  Strip key prefixes before setting
+// Record the changes between the last loaded or committed data and cur to the
+// audit stream.  Failures are logged rather than failing the change as the
+// data has already been written.
+func (a *AppConfig) audit(action string, cur map[string][]byte) {
+	old := a.loaded
+	a.loaded = cur
+
+	key, err := auditKey(a.be)
+	if err != nil {
+		a.log().Warn("recording audit entry failed", "volume", a.QualifiedName(), "err", err)
+		return
+	}
+
+	host, _ := os.Hostname()
+	e := &AuditEntry{
+		Time:    time.Now().UTC(),
+		User:    currentUser(),
+		Host:    host,
+		Source:  a.source,
+		Action:  action,
+		Volume:  a.QualifiedName(),
+		Changes: diffSnapshots(key, old, cur),
+	}
+
+	if err := appendAudit(a.be, e); err != nil {
+		a.log().Warn("recording audit entry failed", "volume", a.QualifiedName(), "err", err)
+	}
+}
+
+// Flattened view of the in mem datastructure keyed the same way data is
+// provided on the command line e.g. db/host, version:db/port or
+// template:config.json
+func (a *AppConfig) snapshot() map[string][]byte {
+	m := map[string][]byte{}
+	for k, v := range a.Keys {
+		m[k] = v
+	}
+	for k, v := range a.VersionKeys {
+		m[ScopeVersion+":"+k] = v
+	}
+	for k, v := range a.AppKeys {
+		m[ScopeApp+":"+k] = v
+	}
+
+	for _, tmpls := range [][]*Template{a.Templates, a.EnvTemplates} {
+		for _, t := range tmpls {
+			m[t.optionKey()] = t.Body
+		}
+	}
+
+	if a.Parent != "" {
+		m["meta:parent"] = []byte(a.Parent)
+	}
+	if a.Schema != nil {
+		m["meta:schema"], _ = json.Marshal(a.Schema)
+	}
+
+	if a.Owner != "" {
+		m["meta:owner"] = []byte(a.Owner)
+	}
+	if a.Description != "" {
+		m["meta:description"] = []byte(a.Description)
+	}
+	for k, v := range a.Labels {
+		m["meta:label:"+k] = []byte(v)
+	}
+
+	if a.AppOwner != "" {
+		m["meta:app:owner"] = []byte(a.AppOwner)
+	}
+	if a.AppDescription != "" {
+		m["meta:app:description"] = []byte(a.AppDescription)
+	}
+	for k, v := range a.AppLabels {
+		m["meta:app:label:"+k] = []byte(v)
+	}
+	return m
+}
+
+// Set input data to  datastructure.  Keys prefixed with shared/app/ and
+// shared/version/ are set on the respective scope, env:templates/ and
+// env:files/ are env template overrides, .meta/parent sets the parent env,
+// .meta/owner, .meta/description and .meta/labels/<label> the metadata of the
+// volume, the same under .meta/app/ the metadata of the app, .schema the
+// schema of the version and all others are set on the env.  Nothing is set if
+// a value violates the schema.
 func (a *AppConfig) Set(data map[string][]byte) error {
+	schema := a.Schema
+	if v, ok := data[schemaKey]; ok {
+		var err error
+		if schema, err = ParseSchema(v); err != nil {
+			return err
+		}
+	}
 
-	for key, v := range data {
-		k := strings.TrimPrefix(key, a.getOpaque(""))
+	for k, v := range data {
+		k = strings.TrimPrefix(k, sharedDir+"/"+ScopeApp+"/")
+		k = strings.TrimPrefix(k, sharedDir+"/"+ScopeVersion+"/")
+		if err := schema.ValidateKey(k, v); err != nil {
+			return err
+		}
+	}
+	a.Schema = schema
+	if _, ok := data[schemaKey]; ok {
+		a.setSchema = true
+	}
+
+	for k, v := range data {
+		delete(a.removed, a.backendKey(k))
 
 		switch {
 
-		case strings.HasPrefix(k, "templates"):
+		case strings.HasPrefix(k, "templates/"), strings.HasPrefix(k, "files/"):
 			if t := NewTemplateFromKey(k); t != nil {
 				t.SetBody(v)
-				a.AddTemplate(t)
+				if err := a.AddTemplate(t); err != nil {
+					return err
+				}
+			}
+
+		case strings.HasPrefix(k, ScopeEnv+":templates/"), strings.HasPrefix(k, ScopeEnv+":files/"):
+			if t := NewTemplateFromKey(strings.TrimPrefix(k, ScopeEnv+":")); t != nil {
+				t.Env = a.Env
+				t.SetBody(v)
+				if err := a.AddTemplate(t); err != nil {
+					return err
+				}
 			}
 
+		case k == metaDir+"/parent":
+			a.Parent = string(v)
+			a.setParent = true
+
+		case k == schemaKey:
+			// set above
+
+		case k == metaDir+"/owner":
+			a.Owner = string(v)
+
+		case k == metaDir+"/description":
+			a.Description = string(v)
+
+		case strings.HasPrefix(k, metaDir+"/"+labelsDir+"/"):
+			a.Labels[strings.TrimPrefix(k, metaDir+"/"+labelsDir+"/")] = string(v)
+
+		case k == appMetaDir+"/owner":
+			a.AppOwner, a.setAppMeta = string(v), true
+
+		case k == appMetaDir+"/description":
+			a.AppDescription, a.setAppMeta = string(v), true
+
+		case strings.HasPrefix(k, appMetaDir+"/"+labelsDir+"/"):
+			a.AppLabels[strings.TrimPrefix(k, appMetaDir+"/"+labelsDir+"/")] = string(v)
+			a.setAppMeta = true
+
+		case strings.HasPrefix(k, sharedDir+"/"+ScopeApp+"/"):
+			a.AppKeys[strings.TrimPrefix(k, sharedDir+"/"+ScopeApp+"/")] = v
+
+		case strings.HasPrefix(k, sharedDir+"/"+ScopeVersion+"/"):
+			a.VersionKeys[strings.TrimPrefix(k, sharedDir+"/"+ScopeVersion+"/")] = v
+
 		default:
-			tk := strings.TrimPrefix(k, a.Env)
-			if tk = strings.TrimPrefix(tk, "/"); tk != "" {
-				a.Keys[tk] = v
+			if k != "" {
+				a.Keys[k] = v
 			}
 
 		}
@@ -172,10 +814,224 @@ func (a *AppConfig) Set(data map[string][]byte) error {
 	return nil
 }
 
+// Remove keys, templates and files from the datastructure.  Keys are in the
+// same format as Set.  The removals are deleted from the backend on Commit.
+func (a *AppConfig) Unset(keys []string) error {
+	for _, k := range keys {
+		found := false
+
+		switch {
+		case strings.HasPrefix(k, "templates/"), strings.HasPrefix(k, "files/"):
+			found = removeTemplate(&a.Templates, k)
+
+		case strings.HasPrefix(k, ScopeEnv+":templates/"), strings.HasPrefix(k, ScopeEnv+":files/"):
+			found = removeTemplate(&a.EnvTemplates, strings.TrimPrefix(k, ScopeEnv+":"))
+
+		case k == metaDir+"/parent":
+			found = a.Parent != ""
+			a.Parent, a.setParent, a.inherited = "", false, nil
+
+		case k == schemaKey:
+			found = a.Schema != nil
+			a.Schema = nil
+
+		case k == metaDir+"/owner":
+			found = a.Owner != ""
+			a.Owner = ""
+
+		case k == metaDir+"/description":
+			found = a.Description != ""
+			a.Description = ""
+
+		case strings.HasPrefix(k, metaDir+"/"+labelsDir+"/"):
+			label := strings.TrimPrefix(k, metaDir+"/"+labelsDir+"/")
+			_, found = a.Labels[label]
+			delete(a.Labels, label)
+
+		case k == appMetaDir+"/owner":
+			found = a.AppOwner != ""
+			a.AppOwner = ""
+
+		case k == appMetaDir+"/description":
+			found = a.AppDescription != ""
+			a.AppDescription = ""
+
+		case strings.HasPrefix(k, appMetaDir+"/"+labelsDir+"/"):
+			label := strings.TrimPrefix(k, appMetaDir+"/"+labelsDir+"/")
+			_, found = a.AppLabels[label]
+			delete(a.AppLabels, label)
+
+		case strings.HasPrefix(k, sharedDir+"/"+ScopeApp+"/"):
+			found = removeKey(a.AppKeys, strings.TrimPrefix(k, sharedDir+"/"+ScopeApp+"/"))
+
+		case strings.HasPrefix(k, sharedDir+"/"+ScopeVersion+"/"):
+			found = removeKey(a.VersionKeys, strings.TrimPrefix(k, sharedDir+"/"+ScopeVersion+"/"))
+
+		default:
+			found = removeKey(a.Keys, k)
+
+		}
+
+		if !found {
+			return fmt.Errorf("not found: '%s'", k)
+		}
+
+		if a.removed == nil {
+			a.removed = map[string]bool{}
+		}
+		a.removed[a.backendKey(k)] = true
+	}
+
+	return nil
+}
+
+// Names of the active templates referencing the key given in the format of
+// Set
+func (a *AppConfig) TemplateRefs(k string) []string {
+	if strings.HasPrefix(strings.TrimPrefix(k, ScopeEnv+":"), "templates/") ||
+		strings.HasPrefix(strings.TrimPrefix(k, ScopeEnv+":"), "files/") || strings.HasPrefix(k, metaDir+"/") || k == schemaKey {
+		return nil
+	}
+	k = strings.TrimPrefix(k, sharedDir+"/"+ScopeApp+"/")
+	k = strings.TrimPrefix(k, sharedDir+"/"+ScopeVersion+"/")
+
+	out := []string{}
+	for _, t := range a.ActiveTemplates() {
+		keys, err := t.Keys()
+		if _, ok := keys[k]; err == nil && ok {
+			out = append(out, t.Name)
+		}
+	}
+	return out
+}
+
+// Backend key of a key in the format of Set
+func (a *AppConfig) backendKey(k string) string {
+	switch {
+	case strings.HasPrefix(k, "templates/"), strings.HasPrefix(k, "files/"), k == schemaKey:
+		return a.getOpaque(k)
+
+	case strings.HasPrefix(k, ScopeEnv+":templates/"), strings.HasPrefix(k, ScopeEnv+":files/"):
+		return a.getOpaque(a.Env + "/" + strings.TrimPrefix(k, ScopeEnv+":"))
+
+	case strings.HasPrefix(k, sharedDir+"/"+ScopeApp+"/"):
+		return a.sharedOpaque() + strings.TrimPrefix(k, sharedDir+"/"+ScopeApp+"/")
+
+	case strings.HasPrefix(k, appMetaDir+"/"):
+		return a.appMetaOpaque() + strings.TrimPrefix(k, appMetaDir+"/")
+
+	case strings.HasPrefix(k, sharedDir+"/"+ScopeVersion+"/"):
+		return a.getOpaque(sharedDir + "/" + strings.TrimPrefix(k, sharedDir+"/"+ScopeVersion+"/"))
+
+	}
+	return a.getOpaque(a.Env + "/" + k)
+}
+
+// Backend keys whose value differs from when the volume was last loaded or
+// committed including the keys to be removed.  All keys are considered changed
+// if the volume was never loaded.
+func (a *AppConfig) changedKeys() map[string]bool {
+	cur := a.snapshot()
+	diff := map[string]bool{}
+	for k, v := range cur {
+		if lv, ok := a.loaded[k]; a.loaded == nil || !ok || !bytes.Equal(lv, v) {
+			diff[k] = true
+		}
+	}
+	for k := range a.loaded {
+		if _, ok := cur[k]; !ok {
+			diff[k] = true
+		}
+	}
+
+	out := map[string]bool{}
+	for k := range diff {
+		if sk, err := optionStorageKey(k); err == nil {
+			out[a.backendKey(sk)] = true
+		}
+	}
+	for k := range a.removed {
+		out[k] = true
+	}
+	return out
+}
+
+// Scope of a backend key of the volume i.e. app, version or env
+func (a *AppConfig) keyScope(k string) string {
+	switch {
+	case strings.HasPrefix(k, a.sharedOpaque()), strings.HasPrefix(k, a.appMetaOpaque()):
+		return ScopeApp
+	case k == a.getOpaque(a.Env), strings.HasPrefix(k, a.getOpaque(a.Env+"/")):
+		return ScopeEnv
+	}
+	return ScopeVersion
+}
+
+// Scope shared with other envs a key in the format of Set belongs to i.e. app
+// for app keys and metadata and version for version keys, templates, files
+// and the schema.  It returns an empty string for keys of the env.
+func sharedScope(k string) string {
+	switch {
+	case strings.HasPrefix(k, sharedDir+"/"+ScopeApp+"/"), strings.HasPrefix(k, appMetaDir+"/"):
+		return ScopeApp
+	case strings.HasPrefix(k, sharedDir+"/"+ScopeVersion+"/"), strings.HasPrefix(k, "templates/"),
+		strings.HasPrefix(k, "files/"), k == schemaKey:
+		return ScopeVersion
+	}
+	return ""
+}
+
+func removeKey(keys ConfigKeys, k string) bool {
+	_, ok := keys[k]
+	delete(keys, k)
+	return ok
+}
+
+// Remove the template or file given by its key e.g. templates/<name>
+func removeTemplate(tmpls *[]*Template, key string) bool {
+	rt := NewTemplateFromKey(key)
+	if rt == nil {
+		return false
+	}
+
+	for i, t := range *tmpls {
+		if t.Name == rt.Name && t.Static == rt.Static {
+			*tmpls = append((*tmpls)[:i], (*tmpls)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (a *AppConfig) getOpaque(n string) string {
 	return a.Name + "/" + a.Version + "/" + n
 }
 
+// Prefix of the keys shared across all versions of the app
+func (a *AppConfig) sharedOpaque() string {
+	return a.Name + "/" + sharedDir + "/"
+}
+
+// Prefix of the metadata of the app
+func (a *AppConfig) appMetaOpaque() string {
+	return a.Name + "/" + metaDir + "/"
+}
+
+// build the app metadata without its prefix to write to backend
+func (a *AppConfig) buildAppMetaMap() map[string][]byte {
+	m := map[string][]byte{}
+	if a.AppOwner != "" {
+		m["owner"] = []byte(a.AppOwner)
+	}
+	if a.AppDescription != "" {
+		m["description"] = []byte(a.AppDescription)
+	}
+	for k, v := range a.AppLabels {
+		m[labelsDir+"/"+k] = []byte(v)
+	}
+	return m
+}
+
 // build payload from in mem data to write to backend
 // it adds the prefix to each key and returns a new map
 func (a *AppConfig) buildBackendDataMap() map[string][]byte {
@@ -189,27 +1045,40 @@ func (a *AppConfig) buildBackendDataMap() map[string][]byte {
 		m[a.Env] = []byte{}
 	}
 
-	// Add prefix to template keys
-	for _, t := range a.Templates {
-		m["templates/"+t.Name] = t.Body
+	if a.Parent != "" || a.setParent {
+		m[a.Env+"/"+metaDir+"/parent"] = []byte(a.Parent)
 	}
 
-	return m
-}
+	if a.Schema != nil && a.setSchema {
+		m[schemaKey], _ = json.Marshal(a.Schema)
+	}
 
-func parseAppName(n string) (name, version, env string, err error) {
-	pp := strings.Split(n, "-")
-	if len(pp) < 3 {
-		err = errInvalidConfName
-		return
+	if a.Owner != "" {
+		m[a.Env+"/"+metaDir+"/owner"] = []byte(a.Owner)
+	}
+	if a.Description != "" {
+		m[a.Env+"/"+metaDir+"/description"] = []byte(a.Description)
+	}
+	for k, v := range a.Labels {
+		m[a.Env+"/"+metaDir+"/"+labelsDir+"/"+k] = []byte(v)
 	}
 
-	env = pp[len(pp)-1]
-	version = pp[len(pp)-2]
-	name = strings.Join(pp[:len(pp)-2], "-")
+	// Add prefix to version scoped keys
+	for k, v := range a.VersionKeys {
+		m[sharedDir+"/"+k] = v
+	}
 
-	if env == "" || version == "" || name == "" {
-		err = errInvalidConfName
+	// Add prefix to template and file keys
+	for _, t := range a.Templates {
+		m[t.Key()] = t.Body
+	}
+	for _, t := range a.EnvTemplates {
+		m[t.Key()] = t.Body
 	}
-	return
+
+	return m
+}
+
+func parseAppName(n string) (name, version, env string, err error) {
+	return volumeNaming.Parse(n)
 }
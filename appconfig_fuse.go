@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"strings"
 
@@ -48,7 +47,7 @@ func (a *AppConfigFS) Mount() error {
 
 	defer func() {
 		if e := c.Close(); e != nil {
-			log.Println("ERR", e)
+			logger.Error("closing fuse connection failed", "volume", a.acfg.QualifiedName(), "err", e)
 		}
 	}()
 
@@ -63,7 +62,7 @@ func (a *AppConfigFS) Mount() error {
 var _ fs.Node = (*AppConfig)(nil)
 
 func (ac *AppConfig) Attr(ctx context.Context, attr *fuse.Attr) error {
-	log.Println("Dir.Attr")
+	logger.Debug("fuse attr", "volume", ac.QualifiedName())
 	attr.Inode = 1
 	attr.Mode = os.ModeDir | 0555
 	return nil
@@ -73,9 +72,9 @@ var _ = fs.NodeRequestLookuper(&AppConfig{})
 
 //func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 func (a *AppConfig) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
-	log.Println("Lookup", req.Name)
+	logger.Debug("fuse lookup", "volume", a.QualifiedName(), "name", req.Name)
 
-	for _, v := range a.Templates {
+	for _, v := range a.ActiveTemplates() {
 
 		// File
 		if req.Name == v.Name {
@@ -101,10 +100,10 @@ func (a *AppConfig) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *f
 }
 
 func (a *AppConfig) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	log.Println("ReadDirAll")
+	logger.Debug("fuse readdir", "volume", a.QualifiedName())
 	dirDirs := []fuse.Dirent{}
 
-	for i, v := range a.Templates {
+	for i, v := range a.ActiveTemplates() {
 		fst := strings.Split(v.Name, "/")
 
 		if fst[0] == v.Name {
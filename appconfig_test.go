@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -26,3 +29,301 @@ func Test_parseAppName_Error(t *testing.T) {
 		t.Fatal("should fail")
 	}
 }
+
+func Test_AppConfig_Inheritance(t *testing.T) {
+	be := testDriver.be
+	defer be.DeleteMap("inherit/")
+
+	prod, _ := NewAppConfigFromName("inherit-0.1.0-prod", be)
+	prod.Set(map[string][]byte{"db/host": []byte("prod-db"), "db/port": []byte("5432")})
+	if err := prod.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	stg, _ := NewAppConfigFromName("inherit-0.1.0-stg", be)
+	stg.Set(map[string][]byte{metaDir + "/parent": []byte("prod"), "db/host": []byte("stg-db")})
+	if err := stg.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	stg, err := NewAppConfigFromName("inherit-0.1.0-stg", be)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, scopes := stg.EffectiveKeys()
+	if string(keys["db/host"]) != "stg-db" || scopes["db/host"] != ScopeEnv {
+		t.Errorf("override: %s %s", keys["db/host"], scopes["db/host"])
+	}
+	if string(keys["db/port"]) != "5432" || scopes["db/port"] != "env:prod" {
+		t.Errorf("inherited: %s %s", keys["db/port"], scopes["db/port"])
+	}
+	if src := stg.KeySources()["db/host"]; len(src) != 2 || src[1] != "env:prod" {
+		t.Errorf("sources: %v", src)
+	}
+
+	// prod -> stg -> prod
+	prod.Set(map[string][]byte{metaDir + "/parent": []byte("stg")})
+	if err = prod.Commit(); err == nil {
+		t.Fatal("should fail with cycle")
+	}
+
+	stg.Set(map[string][]byte{metaDir + "/parent": []byte("missing")})
+	if err = stg.Commit(); err == nil {
+		t.Fatal("should fail with missing parent")
+	}
+}
+
+func Test_AppConfig_EffectiveKeys_Precedence(t *testing.T) {
+	ac, _ := NewAppConfigFromName("prec-0.1.0-dev", nil)
+	// dev -> stg -> prod
+	ac.inherited = []keyScope{{"env:stg", ConfigKeys{}}, {"env:prod", ConfigKeys{}}}
+	scopes := map[string]ConfigKeys{
+		ScopeApp:     ac.AppKeys,
+		ScopeVersion: ac.VersionKeys,
+		"env:prod":   ac.inherited[1].keys,
+		"env:stg":    ac.inherited[0].keys,
+		ScopeEnv:     ac.Keys,
+	}
+
+	// every pair of scopes lowest precedence first
+	pairs := []struct {
+		low, high string
+	}{
+		{ScopeApp, ScopeVersion},
+		{ScopeApp, "env:prod"},
+		{ScopeApp, "env:stg"},
+		{ScopeApp, ScopeEnv},
+		{ScopeVersion, "env:prod"},
+		{ScopeVersion, "env:stg"},
+		{ScopeVersion, ScopeEnv},
+		{"env:prod", "env:stg"},
+		{"env:prod", ScopeEnv},
+		{"env:stg", ScopeEnv},
+	}
+	for i, tc := range pairs {
+		k := fmt.Sprintf("key%d", i)
+		scopes[tc.low][k] = []byte(tc.low)
+		scopes[tc.high][k] = []byte(tc.high)
+		// keys without a value do not override
+		scopes[tc.low][k+"/empty"] = []byte(tc.low)
+		scopes[tc.high][k+"/empty"] = nil
+	}
+
+	keys, from := ac.EffectiveKeys()
+	sources := ac.KeySources()
+	for i, tc := range pairs {
+		k := fmt.Sprintf("key%d", i)
+		if string(keys[k]) != tc.high || from[k] != tc.high {
+			t.Errorf("%s over %s: got %s from %s", tc.high, tc.low, keys[k], from[k])
+		}
+		if src := sources[k]; len(src) != 2 || src[0] != tc.high || src[1] != tc.low {
+			t.Errorf("%s over %s: sources %v", tc.high, tc.low, src)
+		}
+		if string(keys[k+"/empty"]) != tc.low || from[k+"/empty"] != tc.low {
+			t.Errorf("empty %s over %s: got %s from %s", tc.high, tc.low, keys[k+"/empty"], from[k+"/empty"])
+		}
+	}
+}
+
+func Test_AppConfig_EnvTemplates(t *testing.T) {
+	be := testDriver.be
+	defer be.DeleteMap("envtmpl/")
+
+	opts, err := parseCreateReqOptions(map[string]string{
+		"k":                    "v",
+		"template:config.json": `{"k": "${k}"}`,
+		"template:other.json":  `{}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, _ := NewAppConfigFromName("envtmpl-0.1.0-dev", be)
+	dev.Set(opts)
+	if err = dev.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, _ = parseCreateReqOptions(map[string]string{
+		"k":                        "prod",
+		"env:template:config.json": `{"k": "${k}", "tls": true}`,
+	})
+	prod, _ := NewAppConfigFromName("envtmpl-0.1.0-prod", be)
+	prod.Set(opts)
+	if err = prod.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "voletc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, exp := range map[string]string{
+		"envtmpl-0.1.0-dev":  `{"k": "v"}`,
+		"envtmpl-0.1.0-prod": `{"k": "prod", "tls": true}`,
+	} {
+		ac, err := NewAppConfigFromName(name, be)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ac.ActiveTemplates()) != 2 {
+			t.Fatalf("%s: wrong template count: %d", name, len(ac.ActiveTemplates()))
+		}
+		if err = ac.Generate(dir); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(dir + "/config.json"); string(b) != exp {
+			t.Errorf("%s: got '%s' want '%s'", name, b, exp)
+		}
+	}
+}
+
+func Test_AppConfig_TemplateFileCollision(t *testing.T) {
+	be := testDriver.be
+	defer be.DeleteMap("collide/")
+
+	ac, _ := NewAppConfigFromName("collide-0.1.0-dev", be)
+	if err := ac.Set(map[string][]byte{"templates/x": []byte("k=${k}")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.Set(map[string][]byte{"files/x": []byte("raw")}); err == nil {
+		t.Error("should fail for a file named like a template")
+	}
+	if err := ac.Set(map[string][]byte{"env:files/x": []byte("raw"), "env:templates/x": []byte("k=${k}")}); err == nil {
+		t.Error("should fail for an env file named like an env template")
+	}
+
+	// written by an older version
+	be.SetMap("collide/0.1.0/", map[string][]byte{"dev": nil, "templates/x": []byte("k=${k}"), "files/x": []byte("raw")})
+	if _, err := NewAppConfigFromName("collide-0.1.0-dev", be); err == nil {
+		t.Error("should fail to load a template and file with the same name")
+	}
+}
+
+func Test_AppConfig_Unset(t *testing.T) {
+	ac, _ := NewAppConfigFromName("unset-0.1.0-dev", nil)
+	ac.Set(map[string][]byte{
+		"db/host":                  []byte("127.0.0.1"),
+		"shared/version/db/port":   []byte("5432"),
+		"templates/config.json":    []byte(`{"host": "${db/host}"}`),
+		"env:files/truststore.jks": []byte("jks"),
+	})
+
+	if err := ac.Unset([]string{"db/host", "shared/version/db/port", "env:files/truststore.jks"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ac.Keys) != 0 || len(ac.VersionKeys) != 0 || len(ac.EnvTemplates) != 0 {
+		t.Errorf("not removed: %+v", ac)
+	}
+	if refs := ac.TemplateRefs("db/host"); len(refs) != 1 || refs[0] != "config.json" {
+		t.Errorf("should be referenced by config.json: %v", refs)
+	}
+
+	if !ac.removed["unset/0.1.0/dev/db/host"] || !ac.removed["unset/0.1.0/shared/db/port"] || !ac.removed["unset/0.1.0/dev/files/truststore.jks"] {
+		t.Errorf("wrong backend keys: %v", ac.removed)
+	}
+
+	// setting a removed key again should not delete it
+	ac.Set(map[string][]byte{"db/host": []byte("10.0.0.1")})
+	if ac.removed["unset/0.1.0/dev/db/host"] {
+		t.Error("should not be removed")
+	}
+
+	if err := ac.Unset([]string{"templates/missing.json"}); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func Test_AppConfig_Labels(t *testing.T) {
+	opts, err := parseCreateReqOptions(map[string]string{
+		"meta:owner":       "payments",
+		"meta:description": "Payment service",
+		"meta:label:team":  "payments",
+		"meta:label:tier":  "backend",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseCreateReqOptions(map[string]string{"meta:unknown": "x"}); err == nil {
+		t.Error("should fail")
+	}
+
+	ac, _ := NewAppConfigFromName("labels-0.1.0-dev", nil)
+	if err = ac.Set(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	md := ac.Metadata()
+	if md["owner"] != "payments" || md["description"] != "Payment service" {
+		t.Errorf("wrong metadata: %+v", md)
+	}
+	if !ac.HasLabels(map[string]string{"team": "payments", "tier": "backend"}) || ac.HasLabels(map[string]string{"team": "search"}) {
+		t.Errorf("wrong labels: %+v", ac.Labels)
+	}
+
+	m := ac.buildBackendDataMap()
+	if string(m["dev/.meta/labels/team"]) != "payments" || string(m["dev/.meta/owner"]) != "payments" {
+		t.Errorf("wrong backend data: %v", m)
+	}
+	if len(ac.Keys) != 0 {
+		t.Errorf("metadata should not be keys: %v", ac.Keys)
+	}
+}
+
+func Test_AppConfig_AppLabels(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("applabels")
+
+	opts, err := parseCreateReqOptions(map[string]string{
+		"meta:app:owner":      "payments",
+		"meta:app:label:team": "payments",
+		"meta:app:label:tier": "backend",
+		"meta:label:tier":     "frontend",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac, _ := NewAppConfigFromName("applabels-0.1.0-dev", ve.be)
+	if err = ac.Set(opts); err != nil {
+		t.Fatal(err)
+	}
+	if err = ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// shared by the volumes of other versions
+	other, _ := NewAppConfigFromName("applabels-0.2.0-prod", ve.be)
+	other.Set(map[string][]byte{"db/host": []byte("127.0.0.1")})
+	if err = other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if md := other.Metadata(); md["owner"] != "payments" {
+		t.Errorf("wrong metadata: %+v", md)
+	}
+	if !other.HasLabels(map[string]string{"team": "payments", "tier": "backend"}) {
+		t.Errorf("wrong labels: %+v", other.EffectiveLabels())
+	}
+	if len(other.Keys) != 1 {
+		t.Errorf("metadata should not be keys: %v", other.Keys)
+	}
+
+	// the labels of the volume take precedence
+	if ac, err = ve.Get("applabels-0.1.0-dev"); err != nil {
+		t.Fatal(err)
+	}
+	if !ac.HasLabels(map[string]string{"team": "payments", "tier": "frontend"}) {
+		t.Errorf("wrong labels: %+v", ac.EffectiveLabels())
+	}
+
+	if err = ac.Unset([]string{appMetaDir + "/owner"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ = ve.Get("applabels-0.2.0-prod"); other.EffectiveOwner() != "" {
+		t.Errorf("owner should be removed: %s", other.EffectiveOwner())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version 1 archives hold keys and templates as strings which cannot carry
+// binary values.  Version 2 base64 encodes all values.
+const (
+	archiveFormat  = "voletc-archive"
+	archiveVersion = 2
+)
+
+// Archive is a self describing export of a volume.  Keys, templates and files
+// are keyed the same way they are provided on the command line e.g. db/host,
+// version:db/port, template:config.json or file:truststore.jks so they can be
+// fed back through AppConfig.Set.  Values are base64 encoded.
+type Archive struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	Volume    string    `json:"volume"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+
+	Keys      map[string][]byte `json:"keys,omitempty"`
+	Templates map[string][]byte `json:"templates,omitempty"`
+	Files     map[string][]byte `json:"files,omitempty"`
+
+	// Encrypted archive contents
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// Build an archive from the in mem datastructure of the volume
+func NewArchive(vol *AppConfig) *Archive {
+	ar := &Archive{
+		Format:    archiveFormat,
+		Version:   archiveVersion,
+		Created:   time.Now().UTC(),
+		Volume:    vol.QualifiedName(),
+		Keys:      map[string][]byte{},
+		Templates: map[string][]byte{},
+		Files:     map[string][]byte{},
+	}
+
+	for k, v := range vol.snapshot() {
+		key := strings.TrimPrefix(k, ScopeEnv+":")
+		switch {
+		case strings.HasPrefix(key, "template:"):
+			ar.Templates[k] = v
+		case strings.HasPrefix(key, "file:"):
+			ar.Files[k] = v
+		default:
+			ar.Keys[k] = v
+		}
+	}
+
+	return ar
+}
+
+// Marshal the archive encrypting its contents if a key is provided
+func (ar *Archive) Marshal(key []byte) ([]byte, error) {
+	b, err := json.MarshalIndent(ar, "", "  ")
+	if err != nil || len(key) == 0 {
+		return b, err
+	}
+
+	env := &Archive{
+		Format:    ar.Format,
+		Version:   ar.Version,
+		Created:   ar.Created,
+		Volume:    ar.Volume,
+		Encrypted: true,
+	}
+	if env.Payload, err = encrypt(key, b); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// Parse an archive decrypting its contents with key if it is encrypted
+func UnmarshalArchive(b, key []byte) (*Archive, error) {
+	ar, err := unmarshalArchive(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if ar.Format != archiveFormat {
+		return nil, fmt.Errorf("not a volume archive")
+	}
+	if ar.Version > archiveVersion {
+		return nil, fmt.Errorf("archive version not supported: %d", ar.Version)
+	}
+
+	if !ar.Encrypted {
+		return ar, nil
+	}
+
+	if len(key) == 0 {
+		return nil, fmt.Errorf("archive is encrypted: key required")
+	}
+
+	pt, err := decrypt(key, ar.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dar, err := unmarshalArchive(pt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive: invalid key")
+	}
+	return dar, nil
+}
+
+// Parse an archive of any version converting the string values of version 1
+func unmarshalArchive(b []byte) (*Archive, error) {
+	var hdr struct {
+		Version   int  `json:"version"`
+		Encrypted bool `json:"encrypted"`
+	}
+	if err := json.Unmarshal(b, &hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr.Version >= 2 || hdr.Encrypted {
+		var ar Archive
+		if err := json.Unmarshal(b, &ar); err != nil {
+			return nil, err
+		}
+		return &ar, nil
+	}
+
+	var v1 struct {
+		Archive
+		Keys      map[string]string `json:"keys"`
+		Templates map[string]string `json:"templates"`
+	}
+	if err := json.Unmarshal(b, &v1); err != nil {
+		return nil, err
+	}
+
+	ar := &v1.Archive
+	ar.Keys, ar.Templates = map[string][]byte{}, map[string][]byte{}
+	for k, v := range v1.Keys {
+		ar.Keys[k] = []byte(v)
+	}
+	for k, v := range v1.Templates {
+		ar.Templates[k] = []byte(v)
+	}
+	return ar, nil
+}
+
+// Data of the archive keyed for AppConfig.Set.  Data shared with the other
+// envs of the destination and the parent are only included if shared is set,
+// otherwise their keys are returned as skipped.
+func (ar *Archive) Data(shared bool) (map[string][]byte, []string, error) {
+	out := map[string][]byte{}
+	skipped := []string{}
+
+	for _, m := range []map[string][]byte{ar.Keys, ar.Templates, ar.Files} {
+		for k, v := range m {
+			if !shared && (isSharedOption(k) || k == "meta:parent") {
+				skipped = append(skipped, k)
+				continue
+			}
+
+			key, err := optionStorageKey(k)
+			if err != nil {
+				return nil, nil, err
+			}
+			out[key] = v
+		}
+	}
+
+	sort.Strings(skipped)
+	return out, skipped, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_Archive(t *testing.T) {
+	opts, err := parseCreateReqOptions(map[string]string{
+		"db/host":                  "127.0.0.1",
+		"version:db/port":          "5432",
+		"app:flag":                 "true",
+		"template:config.json":     "./testdata/config.json",
+		"env:template:config.json": `{}`,
+		"file:truststore.bin":      "./testdata/truststore.bin",
+		// not valid UTF-8
+		"tls/raw":              "\xff\xfe\x00k",
+		"env:template:raw.bin": "\xff${db/host}\xc3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac, _ := NewAppConfigFromName("archive-0.1.0-dev", nil)
+	if err = ac.Set(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "0123456789abcdef"} {
+		b, err := NewArchive(ac).Marshal([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ar, err := UnmarshalArchive(b, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ar.Volume != "archive-0.1.0-dev" {
+			t.Errorf("wrong volume: %s", ar.Volume)
+		}
+
+		data, _, err := ar.Data(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range opts {
+			// placeholders added from template keys have no value
+			if string(data[k]) != string(v) {
+				t.Errorf("key=%q %s: got %q", key, k, data[k])
+			}
+		}
+
+		if key != "" {
+			if _, err = UnmarshalArchive(b, nil); err == nil {
+				t.Error("should fail without key")
+			}
+			if _, err = UnmarshalArchive(b, []byte("fedcba9876543210")); err == nil {
+				t.Error("should fail with wrong key")
+			}
+		}
+
+		// shared data is only imported when asked for
+		data, skipped, err := ar.Data(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(skipped, " ") != "app:flag file:truststore.bin template:config.json version:db/port" {
+			t.Errorf("wrong skipped: %v", skipped)
+		}
+		if _, ok := data["shared/version/db/port"]; ok {
+			t.Error("version key should be skipped")
+		}
+	}
+}
+
+func Test_Archive_V1(t *testing.T) {
+	ar, err := UnmarshalArchive([]byte(`{
+  "format": "voletc-archive",
+  "version": 1,
+  "volume": "archive-0.1.0-dev",
+  "keys": {"db/host": "127.0.0.1"},
+  "templates": {"template:config.json": "{}"},
+  "files": {"file:truststore.bin": "AAE="}
+}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _, err := ar.Data(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data["db/host"]) != "127.0.0.1" || string(data["templates/config.json"]) != "{}" ||
+		string(data["files/truststore.bin"]) != "\x00\x01" {
+		t.Errorf("wrong data: %q", data)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Top level directory of the audit stream i.e. .audit/<day>/<id>.  Entries are
+// only ever appended.
+const auditDir = ".audit"
+
+const auditDayFormat = "2006-01-02"
+
+// Key the values are hashed with so hashes cannot be brute forced by those
+// able to read the audit stream.  It is kept outside of the audit stream and
+// is encrypted along with all other values when an encryption key is used.
+const auditKeyPath = ".keys/audit"
+
+// Days read when a query does not give a start
+const defaultAuditWindow = 7 * 24 * time.Hour
+
+// Audit actions
+const (
+	AuditCreate   = "create"
+	AuditEdit     = "edit"
+	AuditRemove   = "rm"
+	AuditRollback = "rollback"
+	AuditLock     = "lock"
+	AuditUnlock   = "unlock"
+)
+
+// AuditEntry records a single mutation of a volume
+type AuditEntry struct {
+	Time    time.Time      `json:"time"`
+	User    string         `json:"user"`
+	Host    string         `json:"host"`
+	Source  string         `json:"source"`
+	Action  string         `json:"action"`
+	Volume  string         `json:"volume"`
+	Changes []*AuditChange `json:"changes"`
+}
+
+// AuditChange is a changed key along with the hashes of its old and new
+// values.  Hashes are empty when the key was added or removed.
+type AuditChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// AuditQuery filters audit entries.  Zero values match everything except for
+// the time range which defaults to the last 7 days.
+type AuditQuery struct {
+	Volume string
+	Key    string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (q *AuditQuery) match(e *AuditEntry) bool {
+	if q.Volume != "" && e.Volume != q.Volume {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+
+	if q.Key != "" {
+		for _, c := range e.Changes {
+			if c.Key == q.Key {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func currentUser() string {
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return "unknown"
+}
+
+// Key to hash values with.  It is created on first use.
+func auditKey(be Backend) ([]byte, error) {
+	for i := 0; i < 2; i++ {
+		m, err := be.GetMap(auditKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := m[auditKeyPath]; ok {
+			return key, nil
+		}
+
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		// another client may have created it in the meantime
+		if ok, err := be.CompareAndSet(auditKeyPath, nil, key); err != nil || ok {
+			return key, err
+		}
+	}
+	return nil, fmt.Errorf("audit key not found: '%s'", auditKeyPath)
+}
+
+// Short keyed hash of a value so changes can be compared without exposing them
+func valueHash(key, v []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(v)
+	return fmt.Sprintf("%x", mac.Sum(nil))[:16]
+}
+
+// Changed keys between two snapshots sorted by key.  Values are hashed with
+// the given key.
+func diffSnapshots(key []byte, old, cur map[string][]byte) []*AuditChange {
+	out := []*AuditChange{}
+	for k, v := range cur {
+		ov, ok := old[k]
+		switch {
+		case !ok:
+			out = append(out, &AuditChange{Key: k, New: valueHash(key, v)})
+		case string(ov) != string(v):
+			out = append(out, &AuditChange{Key: k, Old: valueHash(key, ov), New: valueHash(key, v)})
+		}
+	}
+	for k, v := range old {
+		if _, ok := cur[k]; !ok {
+			out = append(out, &AuditChange{Key: k, Old: valueHash(key, v)})
+		}
+	}
+
+	sort.Sort(auditChangesByKey(out))
+	return out
+}
+
+// Append an entry to the audit stream
+func appendAudit(be Backend, e *AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	rnd := make([]byte, 4)
+	rand.Read(rnd)
+	id := fmt.Sprintf("%020d-%x", e.Time.UnixNano(), rnd)
+
+	return be.SetMap(auditDir+"/"+e.Time.Format(auditDayFormat)+"/", map[string][]byte{id: b})
+}
+
+// Query the audit stream returning matching entries oldest first.  Only the
+// days within the time range are read.  The range ends now and starts 7 days
+// before its end unless given.
+func queryAudit(be Backend, q *AuditQuery) ([]*AuditEntry, error) {
+	if q.Until.IsZero() {
+		q.Until = time.Now()
+	}
+	if q.Since.IsZero() {
+		q.Since = q.Until.Add(-defaultAuditWindow)
+	}
+
+	prefixes := []string{}
+	for d := q.Since.UTC().Truncate(24 * time.Hour); !d.After(q.Until.UTC()); d = d.Add(24 * time.Hour) {
+		prefixes = append(prefixes, auditDir+"/"+d.Format(auditDayFormat)+"/")
+	}
+
+	out := []*AuditEntry{}
+	for _, p := range prefixes {
+		m, err := be.GetMap(p)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			var e AuditEntry
+			if err = json.Unmarshal(m[k], &e); err != nil {
+				return nil, fmt.Errorf("invalid audit entry '%s': %v", k, err)
+			}
+			if q.match(&e) {
+				out = append(out, &e)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// Parse a point in time given as RFC3339, a date or a duration relative to now
+// e.g. 24h
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(auditDayFormat, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(s, "-")); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: '%s'", s)
+}
+
+type auditChangesByKey []*AuditChange
+
+func (a auditChangesByKey) Len() int           { return len(a) }
+func (a auditChangesByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+func (a auditChangesByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
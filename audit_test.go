@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Audit(t *testing.T) {
+	be := testDriver.be
+	defer be.DeleteMap("audit/")
+	defer be.DeleteMap(revisionsDir + "/audit/")
+	defer be.DeleteMap(auditDir + "/")
+
+	start := time.Now().Add(-time.Second)
+
+	ac, _ := NewAppConfigFromName("audit-0.1.0-prod", be)
+	ac.source = "cli"
+	ac.Set(map[string][]byte{"db/host": []byte("h1"), "db/port": []byte("5432")})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, _ = NewAppConfigFromName("audit-0.1.0-prod", be)
+	ac.Set(map[string][]byte{"db/host": []byte("h2")})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &AuditQuery{Volume: "audit-0.1.0-prod", Since: start, Until: time.Now()}
+	entries, err := queryAudit(be, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("wrong entry count: %d", len(entries))
+	}
+	for i, a := range []string{AuditCreate, AuditEdit, AuditRemove} {
+		if entries[i].Action != a {
+			t.Errorf("wrong action %d: %s", i, entries[i].Action)
+		}
+	}
+	if entries[0].Source != "cli" || len(entries[0].Changes) != 2 {
+		t.Errorf("wrong create entry: %+v", entries[0])
+	}
+
+	key, err := auditKey(be)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := entries[1].Changes
+	if len(c) != 1 || c[0].Key != "db/host" || c[0].Old != valueHash(key, []byte("h1")) || c[0].New != valueHash(key, []byte("h2")) {
+		t.Errorf("wrong edit changes: %+v", c)
+	}
+	if c[0].New == valueHash([]byte("other"), []byte("h2")) {
+		t.Error("hash should depend on the key")
+	}
+
+	q.Key = "db/port"
+	if entries, _ = queryAudit(be, q); len(entries) != 2 {
+		t.Errorf("wrong key entry count: %d", len(entries))
+	}
+
+	// the last 7 days are read by default
+	q = &AuditQuery{Volume: "audit-0.1.0-prod"}
+	if entries, _ = queryAudit(be, q); len(entries) != 3 {
+		t.Errorf("wrong default entry count: %d", len(entries))
+	}
+	if q.Until.Sub(q.Since) != defaultAuditWindow {
+		t.Errorf("wrong default window: %s", q.Until.Sub(q.Since))
+	}
+}
+
+func Test_parseAuditTime(t *testing.T) {
+	for _, s := range []string{"2016-10-01", "2016-10-01T10:00:00Z", "24h"} {
+		if _, err := parseAuditTime(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := parseAuditTime("yesterday"); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -11,10 +12,20 @@ import (
 type Backend interface {
 	// Get a key value map under a given prefix
 	GetMap(string) (map[string][]byte, error)
+	// Names of the keys under the prefix without reading their values.  With
+	// a separator keys are only listed up to and including the first
+	// separator after the prefix.
+	Keys(prefix, separator string) ([]string, error)
 	// Set key value map under the given prefix
 	SetMap(string, map[string][]byte) error
 	// Delete all keys under the given prefix
 	DeleteMap(string) error
+	// Delete the given keys under the prefix
+	DeleteKeys(string, []string) error
+	// Set the key to the value if its current value is old.  A nil old only
+	// sets the key if it does not exist.  It returns false if the value did
+	// not match.
+	CompareAndSet(key string, old, value []byte) (bool, error)
 
 	KeyExists(string) bool
 }
@@ -34,6 +45,16 @@ func NewBackend(dcfg *DriverConfig) (Backend, error) {
 
 	}
 
+	// Count and time the operations against the backend
+	if err == nil {
+		be = &instrumentedBackend{be: be}
+	}
+
+	// Split values exceeding the backend value size limit
+	if err == nil {
+		be = NewChunkedBackend(be, dcfg.ChunkSize)
+	}
+
 	// Enable encryption
 	if err == nil && len(dcfg.EncryptionKey) > 1 {
 		return &BasicEncryptedBackend{be: be, key: []byte(dcfg.EncryptionKey)}, nil
@@ -79,6 +100,42 @@ func (ebe *BasicEncryptedBackend) SetMap(prefix string, kmap map[string][]byte)
 	return ebe.be.SetMap(prefix, emap)
 }
 
+// Compare and set the key.  The stored value is decrypted for comparison and
+// its ciphertext is passed on so the underlying backend detects changes made
+// in the meantime.
+func (ebe *BasicEncryptedBackend) CompareAndSet(key string, old, value []byte) (bool, error) {
+	var raw []byte
+	if old != nil {
+		m, err := ebe.be.GetMap(key)
+		if err != nil {
+			return false, err
+		}
+		ct, ok := m[key]
+		if !ok {
+			return false, nil
+		}
+		txt, err := ebe.decrypt(append([]byte{}, ct...))
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(txt, old) {
+			return false, nil
+		}
+		raw = ct
+	}
+
+	ct, err := ebe.encrypt(value)
+	if err != nil {
+		return false, err
+	}
+	return ebe.be.CompareAndSet(key, raw, ct)
+}
+
+// Key names are not encrypted
+func (ebe *BasicEncryptedBackend) Keys(prefix, separator string) ([]string, error) {
+	return ebe.be.Keys(prefix, separator)
+}
+
 func (ebe *BasicEncryptedBackend) KeyExists(key string) bool {
 	return ebe.be.KeyExists(key)
 }
@@ -88,6 +145,11 @@ func (ebe *BasicEncryptedBackend) DeleteMap(prefix string) error {
 	return ebe.be.DeleteMap(prefix)
 }
 
+// Delete the given keys under the prefix
+func (ebe *BasicEncryptedBackend) DeleteKeys(prefix string, keys []string) error {
+	return ebe.be.DeleteKeys(prefix, keys)
+}
+
 func (ebe *BasicEncryptedBackend) encrypt(text []byte) ([]byte, error) {
 	return encrypt(ebe.key, text)
 }
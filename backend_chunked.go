@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Consul rejects values and transactions over 512KB where the values of a
+	// transaction are base64 encoded.  Chunks are kept well under the limit so
+	// they fit in a single transaction.
+	defaultChunkSize = 256 * 1024
+	// Bounds of the configurable chunk size.  Smaller chunks result in a
+	// large number of keys per value.
+	minChunkSize = 4 * 1024
+	maxChunkSize = 256 * 1024
+	// Separator between a key and its chunks i.e. <key>@chunks/<sum>/<index>
+	chunkKeySep = "@chunks/"
+)
+
+// Prefix identifying a value as a chunk manifest rather than actual data.
+// Values that start with it are always chunked so they are never mistaken for
+// a manifest.
+var chunkManifestMagic = []byte("voletc:chunked:")
+
+type chunkManifest struct {
+	Size   int    `json:"size"`
+	Chunks int    `json:"chunks"`
+	Sha256 string `json:"sha256"`
+}
+
+// Directory the chunks are stored under relative to the key
+func (cm *chunkManifest) dir() string {
+	return chunkKeySep + cm.Sha256[:16] + "/"
+}
+
+// ChunkedBackend transparently splits values larger than the chunk size into
+// chunks stored alongside the key, writing a manifest with the checksum of the
+// complete value in its place.  Chunks are content addressed and all of them
+// are written before any manifest, so a manifest never points at chunks that
+// are missing.  The manifests and the remaining values are published in a
+// single final write.
+type ChunkedBackend struct {
+	be Backend
+
+	size int
+
+	// Chunk directory of the keys read or written by this backend.  Keys that
+	// were not chunked have an empty directory.
+	mu    sync.Mutex
+	known map[string]string
+}
+
+func NewChunkedBackend(be Backend, size int) *ChunkedBackend {
+	if size < 1 {
+		size = defaultChunkSize
+	}
+	return &ChunkedBackend{be: be, size: size, known: map[string]string{}}
+}
+
+// Get a key value map under a given prefix reassembling chunked values
+func (cb *ChunkedBackend) GetMap(prefix string) (map[string][]byte, error) {
+	m, err := cb.be.GetMap(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string][]byte{}
+	dirs := map[string]string{}
+	for k, v := range m {
+		if strings.Contains(k, chunkKeySep) {
+			continue
+		}
+
+		if !bytes.HasPrefix(v, chunkManifestMagic) {
+			out[k] = v
+			dirs[k] = ""
+			continue
+		}
+
+		var cm *chunkManifest
+		if cm, err = parseChunkManifest(k, v); err != nil {
+			return nil, err
+		}
+		if out[k], err = cb.assemble(k, cm, m); err != nil {
+			return nil, err
+		}
+		dirs[k] = cm.dir()
+	}
+	cb.remember(dirs)
+
+	return out, nil
+}
+
+// Set key value map under the given prefix.  All chunks are written first,
+// one per write, followed by the manifests and remaining values in a single
+// write.  Until a manifest is written its chunks are not referenced, so a
+// failure partway leaves the previous values in place.  Chunks of previous
+// values are removed once the new values have been committed.
+func (cb *ChunkedBackend) SetMap(prefix string, kmap map[string][]byte) error {
+	out := map[string][]byte{}
+	chunks := map[string][]byte{}
+	dirs := map[string]string{}
+
+	plain := cb.plainKeys(kmap)
+	for k, v := range kmap {
+		if plain[k] {
+			out[k] = v
+			dirs[k] = ""
+			continue
+		}
+
+		cm := &chunkManifest{
+			Size:   len(v),
+			Sha256: fmt.Sprintf("%x", sha256.Sum256(v)),
+		}
+		for i := 0; i < len(v); i += cb.size {
+			end := i + cb.size
+			if end > len(v) {
+				end = len(v)
+			}
+			chunks[k+cm.dir()+fmt.Sprintf("%06d", cm.Chunks)] = v[i:end]
+			cm.Chunks++
+		}
+
+		b, _ := json.Marshal(cm)
+		out[k] = append(append([]byte{}, chunkManifestMagic...), b...)
+		dirs[k] = cm.dir()
+	}
+
+	for k, v := range chunks {
+		if err := cb.be.SetMap(prefix, map[string][]byte{k: v}); err != nil {
+			return err
+		}
+	}
+
+	if err := cb.be.SetMap(prefix, out); err != nil {
+		return err
+	}
+
+	return cb.removeStaleChunks(prefix, dirs)
+}
+
+// Keys whose values are written as is.  Values larger than the chunk size or
+// starting like a manifest are chunked, as are the largest of the remaining
+// values until the rest fit in a single write of the chunk size.
+func (cb *ChunkedBackend) plainKeys(kmap map[string][]byte) map[string]bool {
+	plain := map[string]bool{}
+	size := 0
+	for k, v := range kmap {
+		if len(v) <= cb.size && !bytes.HasPrefix(v, chunkManifestMagic) {
+			plain[k] = true
+			size += len(k) + len(v)
+		}
+	}
+
+	for size > cb.size {
+		largest := ""
+		for k := range plain {
+			if largest == "" || len(kmap[k]) > len(kmap[largest]) {
+				largest = k
+			}
+		}
+		delete(plain, largest)
+		size -= len(largest) + len(kmap[largest])
+	}
+	return plain
+}
+
+// Compare and set values that fit in a single chunk.  Larger values and values
+// starting like a manifest cannot be swapped atomically and are refused.
+func (cb *ChunkedBackend) CompareAndSet(key string, old, value []byte) (bool, error) {
+	if len(value) > cb.size || bytes.HasPrefix(value, chunkManifestMagic) {
+		return false, fmt.Errorf("value too large to compare and set: '%s'", key)
+	}
+	return cb.be.CompareAndSet(key, old, value)
+}
+
+// Names of the keys under the prefix leaving out the chunks
+func (cb *ChunkedBackend) Keys(prefix, separator string) ([]string, error) {
+	keys, err := cb.be.Keys(prefix, separator)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !strings.Contains(k, chunkKeySep) {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+func (cb *ChunkedBackend) KeyExists(key string) bool {
+	return cb.be.KeyExists(key)
+}
+
+// Delete all keys under the given prefix.  Chunks share the prefix of their key
+// and are removed along with it.
+func (cb *ChunkedBackend) DeleteMap(prefix string) error {
+	if err := cb.be.DeleteMap(prefix); err != nil {
+		return err
+	}
+
+	cb.mu.Lock()
+	for k := range cb.known {
+		if strings.HasPrefix(k, prefix) {
+			delete(cb.known, k)
+		}
+	}
+	cb.mu.Unlock()
+	return nil
+}
+
+// Delete the given keys under the prefix along with their chunks
+func (cb *ChunkedBackend) DeleteKeys(prefix string, keys []string) error {
+	if err := cb.be.DeleteKeys(prefix, keys); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := cb.be.DeleteMap(prefix + k + chunkKeySep); err != nil {
+			return err
+		}
+	}
+
+	cb.mu.Lock()
+	for _, k := range keys {
+		delete(cb.known, prefix+k)
+	}
+	cb.mu.Unlock()
+	return nil
+}
+
+// Record the chunk directories of the given keys
+func (cb *ChunkedBackend) remember(dirs map[string]string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for k, d := range dirs {
+		cb.known[k] = d
+	}
+}
+
+// Chunk directory of the key as last read or written and whether the key is
+// known at all
+func (cb *ChunkedBackend) chunkDir(key string) (string, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	dir, ok := cb.known[key]
+	return dir, ok
+}
+
+// Remove chunks that are no longer referenced by the manifests just written.
+// Only keys that were chunked before are looked up.  Keys this backend has not
+// seen yet are checked for chunks without reading their values.
+func (cb *ChunkedBackend) removeStaleChunks(prefix string, dirs map[string]string) error {
+	defer cb.remember(prefixKeys(prefix, dirs))
+
+	for k, newDir := range dirs {
+		oldDir, ok := cb.chunkDir(prefix + k)
+		switch {
+		case ok && (oldDir == "" || oldDir == newDir):
+			continue
+		case ok:
+			if err := cb.be.DeleteMap(prefix + k + oldDir); err != nil {
+				return err
+			}
+			continue
+		case !cb.be.KeyExists(prefix + k + chunkKeySep):
+			continue
+		}
+
+		m, err := cb.be.GetMap(prefix + k + chunkKeySep)
+		if err != nil {
+			return err
+		}
+
+		stale := map[string]bool{}
+		for ck := range m {
+			// <prefix><key>@chunks/<sum>/<index>
+			i := strings.LastIndex(ck, chunkKeySep)
+			dir := ck[i : strings.LastIndex(ck, "/")+1]
+			if dir != newDir {
+				stale[ck[:i]+dir] = true
+			}
+		}
+
+		for d := range stale {
+			if err = cb.be.DeleteMap(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Keys of the map with the prefix added
+func prefixKeys(prefix string, m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[prefix+k] = v
+	}
+	return out
+}
+
+func parseChunkManifest(key string, manifest []byte) (*chunkManifest, error) {
+	var cm chunkManifest
+	if err := json.Unmarshal(manifest[len(chunkManifestMagic):], &cm); err != nil {
+		return nil, fmt.Errorf("invalid chunk manifest '%s': %v", key, err)
+	}
+	if len(cm.Sha256) < 16 {
+		return nil, fmt.Errorf("invalid chunk manifest '%s': checksum missing", key)
+	}
+	return &cm, nil
+}
+
+// Reassemble a value from its manifest and the chunks in m.  Chunks share the
+// key as a prefix so they are always part of the same listing.
+func (cb *ChunkedBackend) assemble(key string, cm *chunkManifest, m map[string][]byte) ([]byte, error) {
+
+	ckeys := []string{}
+	for k := range m {
+		if strings.HasPrefix(k, key+cm.dir()) {
+			ckeys = append(ckeys, k)
+		}
+	}
+	sort.Strings(ckeys)
+
+	if len(ckeys) != cm.Chunks {
+		return nil, fmt.Errorf("chunks missing '%s': have %d want %d", key, len(ckeys), cm.Chunks)
+	}
+
+	out := make([]byte, 0, cm.Size)
+	for _, k := range ckeys {
+		out = append(out, m[k]...)
+	}
+
+	if fmt.Sprintf("%x", sha256.Sum256(out)) != cm.Sha256 {
+		return nil, fmt.Errorf("checksum mismatch: '%s'", key)
+	}
+
+	return out, nil
+}
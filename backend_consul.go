@@ -1,12 +1,21 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"fmt"
 	"strings"
 
 	"github.com/hashicorp/consul/api"
 )
 
+// Consul limits the number of operations of a transaction and the size of its
+// request, in which values are base64 encoded, to 512KB.  The size leaves room
+// for the encoding and the keys.
+const (
+	maxConsulTxnOps  = 64
+	maxConsulTxnSize = 320 * 1024
+)
+
 type ConsulBackend struct {
 	cfg    *api.Config
 	client *api.Client
@@ -28,13 +37,18 @@ func NewConsulBackend(addr string, prefix string) (*ConsulBackend, error) {
 }
 
 func (cb *ConsulBackend) KeyExists(key string) bool {
-	kv := cb.client.KV()
-	k, _, err := kv.Keys(cb.getOpaque(key), "", nil)
+	ok, err := cb.keyExists(key)
 	if err != nil {
-		log.Println("WRN", err)
-		return false
+		logger.Warn("consul key lookup failed", "key", key, "err", err)
 	}
-	return len(k) > 0
+	return ok
+}
+
+// Whether the key exists along with the error of the lookup which KeyExists
+// only logs
+func (cb *ConsulBackend) keyExists(key string) (bool, error) {
+	k, _, err := cb.client.KV().Keys(cb.getOpaque(key), "", nil)
+	return err == nil && len(k) > 0, err
 }
 
 func (cb *ConsulBackend) getOpaque(key string) string {
@@ -51,18 +65,58 @@ func (m *ConsulBackend) Set(key string, value []byte) error {
 	return err
 }
 
+// SetMap writes the keys in a single transaction so either all or none of them
+// are written.  Maps exceeding the transaction limits of Consul are refused
+// rather than written partially.
 func (m *ConsulBackend) SetMap(prefix string, mp map[string][]byte) error {
-	kvc := m.client.KV()
+	ops := api.KVTxnOps{}
+	size := 0
+
 	for k, v := range mp {
-		p := &api.KVPair{Key: m.getOpaque(prefix + k), Value: v}
-		if _, err := kvc.Put(p, nil); err != nil {
-			return err
-		}
+		key := m.getOpaque(prefix + k)
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: v})
+		size += len(key) + len(v)
 	}
 
+	if len(ops) > maxConsulTxnOps || size > maxConsulTxnSize {
+		return fmt.Errorf("write too large for a single transaction: %d keys (max %d) %d bytes (max %d)",
+			len(ops), maxConsulTxnOps, size, maxConsulTxnSize)
+	}
+	if len(ops) > 0 {
+		return m.txn(ops)
+	}
 	return nil
 }
 
+// CompareAndSet uses the modify index of the current value so the write fails
+// if the key was changed after it was compared.
+func (m *ConsulBackend) CompareAndSet(key string, old, value []byte) (bool, error) {
+	kvc := m.client.KV()
+	p := &api.KVPair{Key: m.getOpaque(key), Value: value}
+
+	if old != nil {
+		cur, _, err := kvc.Get(p.Key, nil)
+		if err != nil || cur == nil || !bytes.Equal(cur.Value, old) {
+			return false, err
+		}
+		p.ModifyIndex = cur.ModifyIndex
+	}
+
+	ok, _, err := kvc.CAS(p, nil)
+	return ok, err
+}
+
+func (m *ConsulBackend) txn(ops api.KVTxnOps) error {
+	ok, resp, _, err := m.client.KV().Txn(ops, nil)
+	if err == nil && !ok {
+		err = fmt.Errorf("transaction failed")
+		if resp != nil && len(resp.Errors) > 0 {
+			err = fmt.Errorf("transaction failed: %s", resp.Errors[0].What)
+		}
+	}
+	return err
+}
+
 func (m *ConsulBackend) GetMap(prefix string) (map[string][]byte, error) {
 	kvc := m.client.KV()
 	out := map[string][]byte{}
@@ -77,8 +131,38 @@ func (m *ConsulBackend) GetMap(prefix string) (map[string][]byte, error) {
 	return out, err
 }
 
+func (m *ConsulBackend) Keys(prefix, separator string) ([]string, error) {
+	keys, _, err := m.client.KV().Keys(m.getOpaque(prefix), separator, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, m.prefix+"/")
+	}
+	return keys, nil
+}
+
 func (m *ConsulBackend) DeleteMap(prefix string) error {
 	kvc := m.client.KV()
 	_, err := kvc.DeleteTree(m.getOpaque(prefix), nil)
 	return err
 }
+
+// DeleteKeys deletes the exact keys i.e. not the keys they prefix in a single
+// transaction.  More keys than fit in a transaction are refused.
+func (m *ConsulBackend) DeleteKeys(prefix string, keys []string) error {
+	if len(keys) > maxConsulTxnOps {
+		return fmt.Errorf("delete too large for a single transaction: %d keys (max %d)", len(keys), maxConsulTxnOps)
+	}
+
+	ops := api.KVTxnOps{}
+	for _, k := range keys {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVDelete, Key: m.getOpaque(prefix + k)})
+	}
+
+	if len(ops) > 0 {
+		return m.txn(ops)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -16,3 +17,143 @@ func Test_Exists(t *testing.T) {
 		t.Fatal("key should not eixst")
 	}
 }
+
+func Test_ChunkedBackend(t *testing.T) {
+	dcfg := NewDriverConfig(testConsulUri, "./testrun", "test-be-chunked")
+	dcfg.ChunkSize = 16
+
+	be, err := NewBackend(dcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.DeleteMap("")
+
+	large := []byte("0123456789abcdef0123456789abcdef01234")
+	if err = be.SetMap("app/", map[string][]byte{"large": large, "small": []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := be.GetMap("app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || string(m["app/large"]) != string(large) || string(m["app/small"]) != "v" {
+		t.Fatalf("wrong data: %q", m)
+	}
+
+	// Overwrite and make sure the old chunks are gone
+	if err = be.SetMap("app/", map[string][]byte{"large": large[:20]}); err != nil {
+		t.Fatal(err)
+	}
+
+	cbe := be.(*ChunkedBackend)
+	raw, err := cbe.be.GetMap("app/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// manifest + 2 chunks
+	if len(raw) != 3 {
+		t.Fatalf("stale chunks: %d", len(raw))
+	}
+	// A backend that has not seen the key still removes the chunks it replaces
+	other, err := NewBackend(dcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.SetMap("app/", map[string][]byte{"large": large[:30]}); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = cbe.be.GetMap("app/large"); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 3 {
+		t.Fatalf("stale chunks: %d", len(raw))
+	}
+}
+
+func Test_ChunkedBackend_Write(t *testing.T) {
+	dcfg := NewDriverConfig(testConsulUri, "./testrun", "test-be-chunked-write")
+	dcfg.ChunkSize = 16
+
+	be, err := NewBackend(dcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.DeleteMap("")
+
+	// values fitting a chunk each but not together, and a value looking like
+	// a manifest
+	data := map[string][]byte{
+		"a":     []byte("0123456789"),
+		"b":     []byte("0123456789"),
+		"c":     []byte("01234"),
+		"magic": append(append([]byte{}, chunkManifestMagic...), "{}"...),
+	}
+	if err = be.SetMap("app/", data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := be.GetMap("app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range data {
+		if string(m["app/"+k]) != string(v) {
+			t.Errorf("%s: have %q want %q", k, m["app/"+k], v)
+		}
+	}
+
+	// the consul backend refuses writes exceeding a single transaction
+	// instead of writing part of them
+	cbe := be.(*ChunkedBackend)
+	many := map[string][]byte{}
+	for i := 0; i <= maxConsulTxnOps; i++ {
+		many[fmt.Sprintf("%03d", i)] = []byte("v")
+	}
+	if err = cbe.be.SetMap("many/", many); err == nil {
+		t.Error("should fail for too many keys")
+	}
+	if cbe.be.KeyExists("many/") {
+		t.Error("should not write any key")
+	}
+}
+
+func Test_CompareAndSet(t *testing.T) {
+	dcfg := NewDriverConfig(testConsulUri, "./testrun", "test-be-cas")
+	dcfg.EncryptionKey = "0123456789abcdef"
+
+	be, err := NewBackend(dcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.DeleteMap("")
+
+	for i, tc := range []struct {
+		old, value string
+		nilOld, ok bool
+	}{
+		{"", "1", true, true},
+		{"", "2", true, false},
+		{"2", "3", false, false},
+		{"1", "2", false, true},
+	} {
+		var old []byte
+		if !tc.nilOld {
+			old = []byte(tc.old)
+		}
+		ok, err := be.CompareAndSet("head", old, []byte(tc.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.ok {
+			t.Fatalf("%d: have %v want %v", i, ok, tc.ok)
+		}
+	}
+
+	m, err := be.GetMap("head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m["head"]) != "2" {
+		t.Fatalf("wrong value: %q", m["head"])
+	}
+}
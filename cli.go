@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/olekukonko/tablewriter"
 )
@@ -19,14 +23,31 @@ const (
 )
 
 var (
+	configFile = flag.String("config", "", "Config file")
 	backendUri = flag.String("H", defaultConsulUri, "Backend URI")
+	chunkSize  = flag.Int("chunk-size", defaultChunkSize, "Values larger than this are split into chunks")
 	dataPrefix = flag.String("prefix", driverName, "Path prefix to store data under")
 	listenAddr = flag.String("b", "127.0.0.1:8989", "Bind address [server mode only]")
+	sockName   = flag.String("sock", "", "Serve on the unix socket /run/docker/plugins/<name>.sock instead of tcp [server mode only]")
+	statusAddr = flag.String("metrics", "127.0.0.1:8990", "Address serving /metrics, /healthz and /readyz, empty disables [server mode only]")
+	logLvl     = flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logFormat  = flag.String("log-format", LogFmt, "Log format: logfmt or json")
 	baseDir    = flag.String("dir", defaultBaseDir, "Data directory")
 	serverMode = flag.Bool("server", false, "Server mode")
+	rmPolicy   = flag.String("remove-policy", RemoveRetain, "What removing a docker volume does with its data: retain, trash or destroy [server mode only]")
+	trashTTL   = flag.Duration("trash-ttl", defaultTrashTTL, "How long trashed volumes are kept [server mode only]")
+	drainTime  = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests in flight on shutdown [server mode only]")
+	cleanup    = flag.Bool("cleanup", false, "Remove the files of mounted volumes on shutdown [server mode only]")
+	cacheAge   = flag.Duration("cache-max-age", defaultCacheMaxAge, "How long cached volumes are served while the backend is unavailable, 0 disables the cache as does the lack of an encryption key [server mode only]")
+
+	nameFormat = flag.String("naming", defaultNameFormat, "Volume naming format")
+	nameRegexp = flag.String("naming-regexp", "", "Regexp with the named groups name, version and env to parse volume names")
 
 	// These are client tool options
 	encDec    = flag.String("e", "", "Encryption/Decryption key")
+	keyFile   = flag.String("key-file", "", "File containing the encryption/decryption key")
+	ctxName   = flag.String("context", "", "Client context to use instead of the current one")
+	outputFmt = flag.String("o", OutputTable, "Output format: table or json")
 	dryrun    = false
 	answerYes = new(bool)
 )
@@ -42,8 +63,9 @@ Usage:
 
   Key-value pairs are are specified in the following format: path/to/key=value.
   Templates and template files are also specified in the same format but must be
-  prefixed with 'template:'.  When using file paths, absolute or relative paths
-  must be specified
+  prefixed with 'template:'.  Static files (e.g. keystores) that are copied
+  verbatim without rendering must be prefixed with 'file:'.  When using file
+  paths, absolute or relative paths must be specified
 
   Key-Value Examples:
 
@@ -55,40 +77,138 @@ Usage:
 
     template:config.json='{"k": "${path/to/key}"}'
 
+  - Static file with file path as value.  The contents are used as is.
+
+    file:truststore.jks=./truststore.jks
+
   - Key-Value
 
     db/host=127.0.0.1
 
+  - Key-Value shared by all environments of the version or all versions of
+    the app.  Environment keys take precedence over version keys and version
+    keys over app keys.
+
+    version:db/port=5432
+    app:feature/flag=false
+
+  - Inherit keys from another environment of the same version.  Keys set on
+    the environment override the inherited ones.
+
+    meta:parent=prod
+
+  - Template or static file that only applies to the environment.  It is
+    used instead of the version template with the same name.
+
+    env:template:config.json=./etc/prod-config.json
+
+  - Owner, description and labels of the volume, or of the app when
+    prefixed with meta:app:.  The volume's own take precedence.
+
+    meta:owner=payments
+    meta:description='Payment service config'
+    meta:label:team=payments
+    meta:app:label:tier=backend
+
+  - Schema declaring the types of the keys of the version.  Values are
+    validated against it when set.
+
+    meta:schema=./etc/schema.json
+
+  - Remove a key, template or file when editing by prefixing it with '-'.
+    Removing version templates, files or app and version keys affects all
+    environments sharing them and has to be confirmed (or -y given).
+
+    -db/old_key
+    -template:old.json
+
 Commands:
 
   ls        List volumes
   create    Create new volume
   edit      Edit volume configurations
   info      Show volume info
+  cp        Copy volume to a new version or environment
+  promote   Copy templates and/or keys to another volume
   rm        Destroy volume i.e. remove all keys
+  rm-ver    Destroy a version with all of its environments and templates
+  rm-app    Destroy an app with all of its versions
+  gc        Remove templates of versions without environments
+  tree      List apps, versions and environments as a tree
+  alias     Manage version aliases e.g. latest or stable
+  lock      Lock volume against changes and removal
+  unlock    Unlock volume
+  trash     List removed volumes in the trash
+  restore   Restore volume from the trash
   render    Show rendered volume templates
+  history   Show volume revisions
+  rollback  Restore volume to a revision
+  audit     Show changes made to volumes
+  diff      Show differences between volumes or revisions
+  export    Export volume to an archive
+  import    Create volume from an archive
   mount     Mount config volume via fuse (experimental)
+  context   Manage client contexts
   version   Show version
 
 Global Options:
 
+  -config   JSON config file                  (default: $VOLETC_CONFIG)
   -H        Backend URI                       (default: consul://localhost:8500)
   -prefix   Prefix on filesystem and backend  (default: voletc)
+  -chunk-size  Values larger than this are split into chunks
+            (default: 262144, 4096 to 262144)
   -server   Start docker plugin service
+  -naming   Volume naming format              (default: {name}-{version}-{env})
+  -naming-regexp  Regexp with the named groups name, version and env used
+            to parse volume names instead of the format
+  -log-level  debug, info, warn or error     (default: info)
+  -log-format logfmt or json                  (default: logfmt)
 
 Service Options:
   
   -b        Address the service listens on    (default: 127.0.0.1:8989)
+  -sock     Serve on the unix socket /run/docker/plugins/<sock>.sock
+            instead of tcp e.g. -sock voletc
+  -metrics  Address serving /metrics, /healthz and /readyz.  Empty
+            disables                          (default: 127.0.0.1:8990)
   -dir      Directory to store data under     (default: /opt)
+  -remove-policy  What removing a docker volume does with its data i.e.
+            retain, trash or destroy          (default: retain)
+  -trash-ttl  How long trashed volumes are kept (default: 168h)
+  -shutdown-timeout  How long to wait for requests in flight on
+            shutdown                          (default: 30s)
+  -cleanup  Remove the files of mounted volumes on shutdown.  They
+            are rendered again on startup.
+  -cache-max-age  How long cached volumes are served while the
+            backend is unavailable.  0 disables, as does
+            the lack of an encryption key     (default: 24h)
 
 Client Options:
 
   -e        Key to encrypt/decrypt data.  Must be atleast 16
             characters in length. 
+  -key-file File containing the key to encrypt/decrypt data
+  -context  Client context to use instead of the current one
+  -o        Output format of ls, audit and trash i.e. table or
+            json                              (default: table)
+
+Client contexts:
+
+  Contexts kept in ~/.voletc/config hold the backend, prefix, key file and
+  output format of a cluster.  They are used for settings not given as flags
+  or environment variables.
+
+  voletc context add prod backend=consul://consul.prod:8500 prefix=voletc
+  voletc context use prod
+  voletc context ls
+  voletc context rm prod
 `
 
 type cli struct {
 	ve *VolEtc
+	// table or json
+	output string
 }
 
 func newCli(dc *DriverConfig) (*cli, error) {
@@ -96,7 +216,7 @@ func newCli(dc *DriverConfig) (*cli, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &cli{ve: &VolEtc{be: be}}, nil
+	return &cli{ve: &VolEtc{be: be, source: "cli"}, output: *outputFmt}, nil
 }
 
 func (c *cli) Run(args []string) error {
@@ -106,6 +226,9 @@ func (c *cli) Run(args []string) error {
 		return fmt.Errorf("command missing")
 	}
 
+	// command options are parsed per command
+	dryrun, *answerYes = false, false
+
 	switch args[0] {
 
 	case "version":
@@ -124,11 +247,15 @@ func (c *cli) Run(args []string) error {
 		}
 
 		if err == nil {
-			for _, t := range vol.Templates {
+			for _, t := range vol.ActiveTemplates() {
 				fmt.Printf("- %s:\n", t.Name)
+				if t.Static {
+					fmt.Printf("<static file: %d bytes sha1:%s>\n", len(t.Body), t.Sha1)
+					continue
+				}
 
 				var rndrd []byte
-				if rndrd, err = t.Render(vol.Keys.ToString()); err == nil {
+				if rndrd, err = t.Render(vol.renderKeys()); err == nil {
 					fmt.Printf("%s\n", rndrd)
 				}
 			}
@@ -145,15 +272,8 @@ func (c *cli) Run(args []string) error {
 			printDataStructue(vol)
 			parseCliKeyValues(args[2:])
 
-			if !*answerYes {
-				reader := bufio.NewReader(os.Stdin)
-				fmt.Printf("Are you sure you want to destroy '%s' [y/n]? : ", vol.QualifiedName())
-				ans, _ := reader.ReadString('\n')
-				ans = strings.TrimSuffix(ans, "\n")
-
-				if strings.ToLower(ans) != "y" && strings.ToLower(ans) != "yes" {
-					break
-				}
+			if !confirm(fmt.Sprintf("Are you sure you want to destroy '%s'", vol.QualifiedName())) {
+				break
 			}
 
 			fmt.Printf("Destroying volume (%s)...\n", vol.QualifiedName())
@@ -161,6 +281,148 @@ func (c *cli) Run(args []string) error {
 
 		}
 
+	case "rm-ver", "rm-app":
+		if len(args) < 2 || args[1] == "" || (args[0] == "rm-ver" && (len(args) < 3 || args[2] == "")) {
+			err = fmt.Errorf("usage: rm-ver <name> <version> | rm-app <name>")
+			break
+		}
+
+		var tree []*AppTree
+		if tree, err = c.ve.Tree(args[1]); err != nil {
+			break
+		}
+
+		target, opts := args[1], args[2:]
+		if args[0] == "rm-ver" {
+			target, opts = args[1]+"-"+args[2], args[3:]
+			if _, err = c.ve.versionTree(args[1], args[2]); err != nil {
+				break
+			}
+		} else if len(tree) == 0 {
+			err = fmt.Errorf("not found: '%s'", args[1])
+			break
+		}
+
+		printTree(tree)
+		parseCliKeyValues(opts)
+		if !confirm(fmt.Sprintf("Are you sure you want to destroy '%s' and all of its environments", target)) {
+			break
+		}
+
+		fmt.Printf("Destroying %s...\n", target)
+		if args[0] == "rm-ver" {
+			err = c.ve.RemoveVersion(args[1], args[2])
+		} else {
+			err = c.ve.RemoveApp(args[1])
+		}
+
+	case "gc":
+		// apps without environments hold the keys, aliases and metadata
+		// shared by their versions and are only removed with -shared
+		shared := parseCliOptions(args[1:])["shared"]
+
+		var removed []string
+		if removed, err = c.ve.GC(true, shared); err != nil || len(removed) == 0 {
+			break
+		}
+
+		fmt.Println("Orphaned:")
+		for _, r := range removed {
+			fmt.Println("  " + r)
+		}
+		if dryrun || !confirm("Are you sure you want to remove them") {
+			break
+		}
+		_, err = c.ve.GC(false, shared)
+
+	case "trash":
+		var entries []*TrashEntry
+		if entries, err = c.ve.TrashEntries(); err != nil {
+			break
+		}
+		if c.output == OutputJSON {
+			// the archives hold the volume data
+			for _, e := range entries {
+				e.Archive = nil
+			}
+			printJSON(entries)
+		} else {
+			printTrashTable(entries)
+		}
+
+	case "restore":
+		if len(args) < 2 || args[1] == "" {
+			err = errInvalidConfName
+			break
+		}
+		// shared keys changed since the volume was trashed are only
+		// overwritten with -shared
+		if err = c.ve.Restore(args[1], parseCliOptions(args[2:])["shared"]); err == nil {
+			fmt.Printf("Restored volume (%s)\n", args[1])
+		}
+
+	case "lock", "unlock":
+		if len(args) < 2 || args[1] == "" {
+			err = errInvalidConfName
+			break
+		}
+
+		var vol *AppConfig
+		if vol, err = c.ve.Get(args[1]); err != nil {
+			break
+		}
+
+		if args[0] == "lock" {
+			err = vol.Lock()
+		} else {
+			err = vol.Unlock()
+		}
+
+	case "alias":
+		if len(args) < 2 || args[1] == "" {
+			err = fmt.Errorf("usage: alias <name> [alias=version] [-alias]")
+			break
+		}
+
+		var removals []string
+		for _, a := range args[2:] {
+			if strings.HasPrefix(a, "-") && !strings.Contains(a, "=") {
+				removals = append(removals, strings.TrimPrefix(a, "-"))
+			}
+		}
+		for _, a := range removals {
+			if err = c.ve.RemoveAlias(args[1], a); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		for a, v := range parseCliKeyValues(args[2:]) {
+			if err = c.ve.SetAlias(args[1], a, v); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+
+		var aliases map[string]string
+		if aliases, err = c.ve.Aliases(args[1]); err == nil {
+			printAliasTable(aliases)
+		}
+
+	case "tree":
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+
+		var tree []*AppTree
+		if tree, err = c.ve.Tree(name); err == nil {
+			printTree(tree)
+		}
+
 	case "edit":
 		if len(args) < 2 || args[1] == "" {
 			err = errInvalidConfName
@@ -175,10 +437,39 @@ func (c *cli) Run(args []string) error {
 				break
 			}
 
+			var removals []string
+			if removals, err = parseCliRemovals(args[2:]); err != nil {
+				break
+			}
+
+			// version templates and shared keys are used by other envs
+			shared := []string{}
+			for _, k := range removals {
+				if sc := sharedScope(k); sc != "" {
+					shared = append(shared, fmt.Sprintf("'%s' of the %s", k, sc))
+				}
+			}
+			parseCliOptions(args[2:])
+			if len(shared) > 0 && !dryrun &&
+				!confirm(fmt.Sprintf("Removing %s affects all environments sharing it.  Are you sure", strings.Join(shared, ", "))) {
+				break
+			}
+
+			if err = vol.Unset(removals); err != nil {
+				break
+			}
+			for _, k := range removals {
+				for _, n := range vol.TemplateRefs(k) {
+					fmt.Printf("Warning: removed key '%s' is still referenced by template '%s'\n", k, n)
+				}
+			}
+
 			ckvs := parseCliKeyValues(args[2:])
 			var reqOpts map[string][]byte
 			if reqOpts, err = parseCreateReqOptions(ckvs); err == nil {
-				vol.Set(reqOpts)
+				if err = vol.Set(reqOpts); err != nil {
+					break
+				}
 				if !dryrun {
 					err = vol.Commit()
 				}
@@ -206,14 +497,78 @@ func (c *cli) Run(args []string) error {
 			}
 		}
 
+	case "cp", "promote":
+		if len(args) < 3 || args[1] == "" || args[2] == "" {
+			err = fmt.Errorf("usage: %s <src> <dst> [key=value] [-shared]", args[0])
+			break
+		}
+
+		var src, dst *AppConfig
+		if src, err = c.ve.Get(args[1]); err != nil {
+			break
+		}
+
+		// cp creates a new volume with all of the data.  promote copies
+		// templates and/or keys to a new or existing volume.  App and version
+		// keys and version templates are shared with the other envs of the
+		// destination and only copied with -shared.
+		what, shared, kvs := CopyAll, 0, []string{}
+		for _, o := range args[3:] {
+			switch {
+			case args[0] == "promote" && o == "-keys":
+				what = CopyKeys
+			case args[0] == "promote" && o == "-templates":
+				what = CopyTemplates
+			case o == "-shared":
+				shared = CopyShared
+			default:
+				kvs = append(kvs, o)
+			}
+		}
+		what |= shared
+
+		if args[0] == "cp" {
+			if _, err = c.ve.Get(args[2]); err == nil {
+				err = fmt.Errorf("exists: '%s'", args[2])
+				break
+			}
+		}
+
+		if dst, err = c.buildAppConfig(args[2], nil); err != nil {
+			break
+		}
+
+		var overrides map[string][]byte
+		if overrides, err = parseCreateReqOptions(parseCliKeyValues(kvs)); err != nil {
+			break
+		}
+
+		if err = dst.CopyFrom(src, what, overrides); err == nil {
+			if !dryrun {
+				err = dst.Commit()
+			}
+			printDataStructue(dst)
+		}
+
 	case "info":
 		if len(args) < 2 || args[1] == "" {
 			err = errInvalidConfName
 			break
 		}
+		var resolved string
+		if resolved, err = c.ve.Resolve(args[1]); err != nil {
+			break
+		}
+
 		var vol *AppConfig
-		if vol, err = c.ve.Get(args[1]); err == nil {
+		if vol, err = c.ve.Get(resolved); err == nil {
+			if resolved != args[1] {
+				fmt.Printf("Resolved: %s -> %s\n", args[1], resolved)
+			}
 			printDataStructue(vol)
+			printAliases(c.ve, vol)
+			printKeyScopes(vol)
+			printSchema(vol.Schema)
 		}
 
 	case "mount":
@@ -232,7 +587,7 @@ func (c *cli) Run(args []string) error {
 
 		go func() {
 			if e := acfs.Mount(); e != nil {
-				fmt.Println("ERR", e)
+				logger.Error("fuse mount failed", "volume", vol.QualifiedName(), "err", e)
 			}
 			done <- true
 		}()
@@ -248,10 +603,203 @@ func (c *cli) Run(args []string) error {
 			err = acfs.Unmount()
 		}
 
+	case "history":
+		if len(args) < 2 || args[1] == "" {
+			err = errInvalidConfName
+			break
+		}
+
+		var vol *AppConfig
+		if vol, err = c.ve.Get(args[1]); err == nil {
+			var revs []*Revision
+			if revs, err = vol.Revisions(); err == nil {
+				printRevisionTable(revs)
+			}
+		}
+
+	case "rollback":
+		if len(args) < 3 || args[1] == "" {
+			err = fmt.Errorf("usage: rollback <name> <revision>")
+			break
+		}
+
+		var rev int
+		if rev, err = strconv.Atoi(args[2]); err != nil {
+			err = fmt.Errorf("invalid revision: '%s'", args[2])
+			break
+		}
+
+		// app and version keys and version templates are shared with other
+		// envs and only restored with -shared
+		shared := parseCliOptions(args[3:])["shared"]
+
+		var vol *AppConfig
+		if vol, err = c.ve.Get(args[1]); err == nil {
+			if dryrun {
+				if err = vol.LoadRevision(rev, shared); err == nil {
+					printDataStructue(vol)
+				}
+				break
+			}
+
+			fmt.Printf("Rolling back volume (%s) to revision %d...\n", vol.QualifiedName(), rev)
+			err = vol.Rollback(rev, shared)
+		}
+
+	case "export":
+		if len(args) < 2 || args[1] == "" {
+			err = errInvalidConfName
+			break
+		}
+
+		var vol *AppConfig
+		if vol, err = c.ve.Get(args[1]); err != nil {
+			break
+		}
+
+		opts := parseCliKeyValues(args[2:])
+		var b []byte
+		if b, err = NewArchive(vol).Marshal([]byte(opts["key"])); err != nil {
+			break
+		}
+
+		if out := opts["out"]; out != "" && out != "-" {
+			err = ioutil.WriteFile(out, b, 0600)
+		} else {
+			fmt.Printf("%s\n", b)
+		}
+
+	case "import":
+		if len(args) < 2 || args[1] == "" {
+			err = fmt.Errorf("usage: import <file> [name] [-shared]")
+			break
+		}
+
+		var b []byte
+		if args[1] == "-" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(args[1])
+		}
+		if err != nil {
+			break
+		}
+
+		name := ""
+		if len(args) > 2 && !strings.HasPrefix(args[2], "-") && !strings.Contains(args[2], "=") {
+			name = args[2]
+		}
+		opts := parseCliKeyValues(args[2:])
+		// app and version keys, version templates, the schema and the parent
+		// are shared with or refer to other envs and only imported with
+		// -shared
+		shared := parseCliOptions(args[2:])["shared"]
+
+		var ar *Archive
+		if ar, err = UnmarshalArchive(b, []byte(opts["key"])); err != nil {
+			break
+		}
+		if name == "" {
+			name = ar.Volume
+		}
+
+		if _, err = c.ve.Get(name); err == nil {
+			err = fmt.Errorf("exists: '%s'", name)
+			break
+		}
+
+		var vol *AppConfig
+		if vol, err = c.buildAppConfig(name, nil); err != nil {
+			break
+		}
+
+		var (
+			data    map[string][]byte
+			skipped []string
+		)
+		if data, skipped, err = ar.Data(shared); err != nil {
+			break
+		}
+		if len(skipped) > 0 {
+			fmt.Printf("Skipping data shared with other envs, use -shared to import it: %s\n", strings.Join(skipped, ", "))
+		}
+		if err = vol.Set(data); err == nil {
+			if !dryrun {
+				fmt.Printf("Importing volume (%s) as %s...\n", ar.Volume, vol.QualifiedName())
+				err = vol.Commit()
+			}
+			printDataStructue(vol)
+		}
+
+	case "diff":
+		if len(args) < 3 || args[1] == "" || args[2] == "" {
+			err = fmt.Errorf("usage: diff <name>[#rev] <name>[#rev] [-rendered] [-show-secrets]")
+			break
+		}
+
+		var a, b *AppConfig
+		if a, err = c.getRevision(args[1]); err != nil {
+			break
+		}
+		if b, err = c.getRevision(args[2]); err != nil {
+			break
+		}
+
+		showSecrets, rendered := false, false
+		for _, o := range args[3:] {
+			switch o {
+			case "-rendered":
+				rendered = true
+			case "-show-secrets":
+				showSecrets = true
+			}
+		}
+
+		var vd *VolumeDiff
+		if vd, err = DiffVolumes(a, b, rendered, showSecrets); err != nil {
+			break
+		}
+
+		if vd.Empty() {
+			fmt.Println("No differences")
+		} else {
+			fmt.Print(vd.String())
+		}
+
+	case "audit":
+		var q *AuditQuery
+		if q, err = parseAuditQuery(args[1:]); err != nil {
+			break
+		}
+
+		var entries []*AuditEntry
+		if entries, err = queryAudit(c.ve.be, q); err != nil {
+			break
+		}
+		if c.output == OutputJSON {
+			printJSON(entries)
+		} else {
+			printAuditTable(entries, q.Key)
+		}
+
 	case "ls":
+		var labels map[string]string
+		if labels, err = parseLabelSelector(args[1:]); err != nil {
+			break
+		}
+
 		var vols map[string]*AppConfig
 		if vols, err = c.ve.List(); err == nil {
-			printVolumeTable(vols)
+			for k, vol := range vols {
+				if !vol.HasLabels(labels) {
+					delete(vols, k)
+				}
+			}
+			if c.output == OutputJSON {
+				printVolumesJSON(vols)
+			} else {
+				printVolumeTable(vols)
+			}
 		}
 
 	default:
@@ -262,9 +810,28 @@ func (c *cli) Run(args []string) error {
 	return err
 }
 
+// Get a volume or a revision of it given as <name>#<rev>
+func (c *cli) getRevision(arg string) (*AppConfig, error) {
+	name, rev := arg, 0
+	if i := strings.LastIndex(arg, "#"); i > 0 {
+		var err error
+		if rev, err = strconv.Atoi(arg[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid revision: '%s'", arg[i+1:])
+		}
+		name = arg[:i]
+	}
+
+	vol, err := c.ve.Get(name)
+	if err == nil && rev > 0 {
+		err = vol.LoadRevision(rev, true)
+	}
+	return vol, err
+}
+
 func (c *cli) buildAppConfig(name string, args []string) (*AppConfig, error) {
 	vol, err := NewAppConfigFromName(name, c.ve.be)
 	if err == nil {
+		vol.source = c.ve.source
 		if len(args) > 0 {
 			ckvs := parseCliKeyValues(args)
 			var reqOpts map[string][]byte
@@ -277,9 +844,137 @@ func (c *cli) buildAppConfig(name string, args []string) (*AppConfig, error) {
 
 }
 
+// Parse label selectors given as -l <label>=<value>
+func parseLabelSelector(args []string) (map[string]string, error) {
+	out := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-l" {
+			continue
+		}
+		if i+1 == len(args) || !strings.Contains(args[i+1], "=") {
+			return nil, fmt.Errorf("usage: ls [-l label=value]")
+		}
+
+		i++
+		pp := strings.SplitN(args[i], "=", 2)
+		out[pp[0]] = pp[1]
+	}
+	return out, nil
+}
+
+// Ask the user to confirm unless -y was given
+func confirm(msg string) bool {
+	if *answerYes {
+		return true
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("%s [y/n]? : ", msg)
+	ans, _ := reader.ReadString('\n')
+	ans = strings.ToLower(strings.TrimSuffix(ans, "\n"))
+
+	return ans == "y" || ans == "yes"
+}
+
+func printSchema(s Schema) {
+	if len(s) == 0 {
+		return
+	}
+
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"key", "type", "required", "description"})
+	for _, k := range s.Keys() {
+		ks := s[k]
+		typ := ks.Type
+		switch typ {
+		case "":
+			typ = TypeString
+		case TypeEnum:
+			typ += "(" + strings.Join(ks.Values, ",") + ")"
+		case TypeRegex:
+			typ += "(" + ks.Pattern + ")"
+		}
+		tw.Append([]string{k, typ, strconv.FormatBool(ks.Required), ks.Description})
+	}
+
+	fmt.Println()
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
+
+// Print the aliases pointing at the version of the volume
+func printAliases(ve *VolEtc, vol *AppConfig) {
+	aliases, err := ve.Aliases(vol.Name)
+	if err != nil {
+		return
+	}
+
+	names := []string{}
+	for a, v := range aliases {
+		if v == vol.Version {
+			names = append(names, a)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		fmt.Printf("Aliases: %s\n", strings.Join(names, ", "))
+	}
+}
+
+func printAliasTable(aliases map[string]string) {
+	names := make([]string, 0, len(aliases))
+	for a := range aliases {
+		names = append(names, a)
+	}
+	sort.Strings(names)
+
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"alias", "version"})
+	for _, a := range names {
+		tw.Append([]string{a, aliases[a]})
+	}
+
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
+
+// Print apps, versions and environments as a tree.  Versions without any
+// environments are marked as orphaned.
+func printTree(tree []*AppTree) {
+	for _, app := range tree {
+		fmt.Println(app.Name)
+		for i, vt := range app.Versions {
+			branch, indent := "├── ", "│   "
+			if i == len(app.Versions)-1 {
+				branch, indent = "└── ", "    "
+			}
+
+			info := fmt.Sprintf("(templates: %d)", vt.Templates)
+			if vt.Orphaned() {
+				info = fmt.Sprintf("(templates: %d, orphaned)", vt.Templates)
+			}
+			fmt.Printf("%s%s %s\n", branch, vt.Version, info)
+
+			for j, env := range vt.Envs {
+				if j == len(vt.Envs)-1 {
+					fmt.Printf("%s└── %s\n", indent, env)
+				} else {
+					fmt.Printf("%s├── %s\n", indent, env)
+				}
+			}
+		}
+	}
+}
+
 func printVolumeTable(vols map[string]*AppConfig) {
 	tw := tablewriter.NewWriter(os.Stdout)
-	tw.SetHeader([]string{"volume id", "name", "version", "env", "keys", "files"})
+	tw.SetHeader([]string{"volume id", "name", "version", "env", "keys", "files", "owner", "locked"})
 
 	for _, vol := range vols {
 		md := vol.Metadata()
@@ -290,6 +985,100 @@ func printVolumeTable(vols map[string]*AppConfig) {
 			md["env"].(string),
 			fmt.Sprintf("%d", md["keys"]),
 			fmt.Sprintf("%d", md["files"]),
+			vol.EffectiveOwner(),
+			vol.LockedBy,
+		})
+	}
+
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
+
+// Parse audit arguments i.e. [name] [key=<key>] [since=<time>] [until=<time>]
+func parseAuditQuery(args []string) (*AuditQuery, error) {
+	q := &AuditQuery{}
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		q.Volume = args[0]
+		args = args[1:]
+	}
+
+	var err error
+	for k, v := range parseCliKeyValues(args) {
+		switch k {
+		case "key":
+			q.Key = v
+		case "since":
+			q.Since, err = parseAuditTime(v)
+		case "until":
+			q.Until, err = parseAuditTime(v)
+		default:
+			err = fmt.Errorf("invalid audit filter: '%s'", k)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Print a row per changed key.  Only the given key is shown if not empty.
+func printAuditTable(entries []*AuditEntry, key string) {
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"time", "volume", "action", "user", "host", "source", "key", "old", "new"})
+
+	for _, e := range entries {
+		row := []string{e.Time.Format(time.RFC3339), e.Volume, e.Action, e.User, e.Host, e.Source}
+		if len(e.Changes) == 0 {
+			tw.Append(append(row, "", "", ""))
+		}
+
+		for _, c := range e.Changes {
+			if key == "" || c.Key == key {
+				tw.Append(append(row, c.Key, c.Old, c.New))
+			}
+		}
+	}
+
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
+
+func printTrashTable(entries []*TrashEntry) {
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"volume", "deleted", "expires"})
+
+	for _, e := range entries {
+		tw.Append([]string{e.Volume, e.Deleted.Format(time.RFC3339), e.Expires.Format(time.RFC3339)})
+	}
+
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
+
+func printRevisionTable(revs []*Revision) {
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"rev", "timestamp", "author", "source", "keys", "files", "message"})
+
+	for _, r := range revs {
+		tw.Append([]string{
+			fmt.Sprintf("%d", r.Rev),
+			r.Timestamp.Format(time.RFC3339),
+			r.Author,
+			r.Source,
+			fmt.Sprintf("%d", len(r.Keys)),
+			fmt.Sprintf("%d", len(r.Templates)),
+			r.Message,
 		})
 	}
 
@@ -300,20 +1089,44 @@ func printVolumeTable(vols map[string]*AppConfig) {
 	tw.Render()
 }
 
-// Parse cli key values into a map
+// Print the scope each effective key value comes from along with the scopes
+// it overrides.  Inherited keys are shown with the scope env:<parent>.
+func printKeyScopes(vol *AppConfig) {
+	_, scopes := vol.EffectiveKeys()
+	sources := vol.KeySources()
+
+	keys := make([]string, 0, len(scopes))
+	for k := range scopes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"key", "scope", "overrides"})
+	for _, k := range keys {
+		overrides := ""
+		if src := sources[k]; len(src) > 1 && src[0] == scopes[k] {
+			overrides = strings.Join(src[1:], ",")
+		}
+		tw.Append([]string{k, scopes[k], overrides})
+	}
+
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
+
+// Parse cli key values into a map.  Arguments starting with - are options or
+// removals (see parseCliRemovals) and are not part of the map.
 func parseCliKeyValues(arr []string) map[string]string {
+	parseCliOptions(arr)
+
 	m := map[string]string{}
 	for _, s := range arr {
 		// Treat keys starting with - specially.
 		if strings.HasPrefix(s, "-") {
-			switch {
-			case strings.HasSuffix(s, "-dryrun"):
-				dryrun = true
-
-			case strings.HasSuffix(s, "-y"):
-				*answerYes = true
-			}
-
 			continue
 		}
 
@@ -327,6 +1140,71 @@ func parseCliKeyValues(arr []string) map[string]string {
 	return m
 }
 
+// Parse the options given as -<option> e.g. -dryrun, -y or -shared.  The
+// dryrun and y options are applied, all are returned.
+func parseCliOptions(arr []string) map[string]bool {
+	opts := map[string]bool{}
+	for _, s := range arr {
+		if !strings.HasPrefix(s, "-") || strings.Contains(s, "=") {
+			continue
+		}
+
+		opt := strings.TrimLeft(s, "-")
+		switch opt {
+		case "dryrun":
+			dryrun = true
+
+		case "y":
+			*answerYes = true
+		}
+		opts[opt] = true
+	}
+	return opts
+}
+
+// Parse keys to remove given as -<key> e.g. -db/old_key or
+// -template:old.json and convert them to keys for storage
+func parseCliRemovals(arr []string) ([]string, error) {
+	out := []string{}
+	for _, s := range arr {
+		k := strings.TrimPrefix(s, "-")
+		if k == s || k == "dryrun" || k == "y" || strings.HasPrefix(k, "-") || strings.Contains(k, "=") {
+			continue
+		}
+
+		key, err := optionStorageKey(k)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, key)
+	}
+	return out, nil
+}
+
+func printJSON(v interface{}) {
+	b, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Printf("%s\n", b)
+}
+
+// Print the metadata of the volumes sorted by name
+func printVolumesJSON(vols map[string]*AppConfig) {
+	names := make([]string, 0, len(vols))
+	for k := range vols {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	out := make([]map[string]interface{}, 0, len(vols))
+	for _, k := range names {
+		md := vols[k].Metadata()
+		if vols[k].Locked {
+			md["locked_by"] = vols[k].LockedBy
+		}
+		out = append(out, md)
+	}
+	printJSON(out)
+}
+
 func printDataStructue(v interface{}) {
 	b, _ := json.MarshalIndent(v, " ", "  ")
 	fmt.Printf("%s\n", b)
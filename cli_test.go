@@ -40,17 +40,76 @@ func Test_cli(t *testing.T) {
 		t.Log(err)
 		t.Fail()
 	}
+	if err := cl.Run([]string{"edit", "test2-0.1.0-dev", "meta:owner=payments", "meta:label:team=payments"}); err != nil {
+		t.Fatal(err)
+	}
+	if vol, err := cl.ve.Get("test2-0.1.0-dev"); err != nil || vol.Owner != "payments" || vol.Labels["team"] != "payments" {
+		t.Fatalf("metadata not stored: %v %+v", err, vol)
+	}
+	if err := cl.Run([]string{"ls", "-l", "team=payments"}); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if err := cl.Run([]string{"ls", "-l"}); err == nil {
+		t.Log("should fail")
+		t.Fail()
+	}
+
+	if err := cl.Run([]string{"tree"}); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
 
 	if err := cl.Run([]string{"edit", "test2-0.1.0-dev",
 		"db/username=dbuser,db/password=dbpasswd"}); err != nil {
 		t.Log(err)
 		t.Fail()
 	}
+	// removing a version template needs to be confirmed
+	if err := cl.Run([]string{"edit", "test2-0.1.0-dev", "-db/username", "-template:config.json"}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := cl.ve.Get("test2-0.1.0-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vol.Templates) != 1 {
+		t.Fatalf("removed without confirmation: %+v", vol)
+	}
+
+	if err := cl.Run([]string{"edit", "test2-0.1.0-dev", "-db/username", "-template:config.json", "-y"}); err != nil {
+		t.Fatal(err)
+	}
+	if vol, err = cl.ve.Get("test2-0.1.0-dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vol.Keys["db/username"]; ok || len(vol.Templates) != 0 {
+		t.Errorf("not removed: %+v", vol)
+	}
+	if err := cl.Run([]string{"edit", "test2-0.1.0-dev", "-db/username"}); err == nil {
+		t.Log("should fail")
+		t.Fail()
+	}
+
 	if err := cl.Run([]string{"edit"}); err == nil {
 		t.Log("should fail")
 		t.Fail()
 	}
 
+	if err := cl.Run([]string{"export", "test2-0.1.0-dev", "out=./testrun/test2.json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Run([]string{"import", "./testrun/test2.json", "test2-0.1.0-imported"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Run([]string{"import", "./testrun/test2.json", "test2-0.1.0-imported"}); err == nil {
+		t.Log("should fail")
+		t.Fail()
+	}
+	if err := cl.Run([]string{"rm", "test2-0.1.0-imported", "-y"}); err != nil {
+		t.Fatal(err)
+	}
+
 	if err := cl.Run([]string{"rm", "test2-0.1.0-dev", "-y"}); err != nil {
 		t.Fatal(err)
 	}
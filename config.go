@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configField maps a field of the config file and its environment variable to
+// the flag it sets
+type configField struct {
+	path string
+	flag string
+	env  string
+}
+
+// Settings available in the config file.  Flags take precedence over the
+// environment and the environment over the config file.
+var configFields = []configField{
+	{"backend.uri", "H", "VOLETC_BACKEND"},
+	{"backend.prefix", "prefix", "VOLETC_PREFIX"},
+	{"backend.chunk_size", "chunk-size", "VOLETC_CHUNK_SIZE"},
+	{"dir", "dir", "VOLETC_DIR"},
+	{"key_file", "key-file", "VOLETC_KEY_FILE"},
+	{"naming.format", "naming", "VOLETC_NAMING"},
+	{"naming.regexp", "naming-regexp", "VOLETC_NAMING_REGEXP"},
+	{"log.level", "log-level", "VOLETC_LOG_LEVEL"},
+	{"log.format", "log-format", "VOLETC_LOG_FORMAT"},
+	{"server.listen", "b", "VOLETC_LISTEN"},
+	{"server.socket", "sock", "VOLETC_SOCKET"},
+	{"server.metrics", "metrics", "VOLETC_METRICS"},
+	{"server.remove_policy", "remove-policy", "VOLETC_REMOVE_POLICY"},
+	{"server.trash_ttl", "trash-ttl", "VOLETC_TRASH_TTL"},
+	{"server.shutdown_timeout", "shutdown-timeout", "VOLETC_SHUTDOWN_TIMEOUT"},
+	{"server.cleanup", "cleanup", "VOLETC_CLEANUP"},
+	{"server.cache_max_age", "cache-max-age", "VOLETC_CACHE_MAX_AGE"},
+}
+
+// Environment variable holding the config file if -config is not given
+const configEnvVar = "VOLETC_CONFIG"
+
+// settings records where the value of each flag came from so errors can point
+// at the offending flag, environment variable or config file field
+type settings struct {
+	sources map[string]string
+	// Flags given on the command line or as environment variables
+	explicit map[string]bool
+}
+
+// Error about the value of a flag naming where the value was given
+func (s *settings) errorf(name string, err error) error {
+	if src, ok := s.sources[name]; ok {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	return fmt.Errorf("-%s: %v", name, err)
+}
+
+// Apply the environment and the config file to the flags not given on the
+// command line.  The config file is taken from -config or the environment.
+func applySettings(fs *flag.FlagSet, getenv func(string) string) (*settings, error) {
+	s := &settings{sources: map[string]string{}, explicit: map[string]bool{}}
+	fs.Visit(func(f *flag.Flag) {
+		s.sources[f.Name] = "-" + f.Name
+		s.explicit[f.Name] = true
+	})
+
+	for _, cf := range configFields {
+		if _, ok := s.sources[cf.flag]; ok {
+			continue
+		}
+		if v := getenv(cf.env); v != "" {
+			if err := fs.Set(cf.flag, v); err != nil {
+				return nil, fmt.Errorf("%s: invalid value '%s': %v", cf.env, v, err)
+			}
+			s.sources[cf.flag] = cf.env
+			s.explicit[cf.flag] = true
+		}
+	}
+
+	path := getenv(configEnvVar)
+	if f := fs.Lookup("config"); f != nil && f.Value.String() != "" {
+		path = f.Value.String()
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	values, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cf := range configFields {
+		v, ok := values[cf.path]
+		if _, set := s.sources[cf.flag]; !ok || set {
+			continue
+		}
+		if err = fs.Set(cf.flag, v); err != nil {
+			return nil, fmt.Errorf("%s: %s: invalid value '%s': %v", path, cf.path, v, err)
+		}
+		s.sources[cf.flag] = path + ": " + cf.path
+	}
+
+	return s, nil
+}
+
+// Read a json config file into its values keyed by field path e.g.
+// server.listen.  Unknown fields and values that are not scalars are errors.
+func loadConfigFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&m); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(b[:se.Offset], []byte("\n")) + 1
+			return nil, fmt.Errorf("%s: line %d: %v", path, line, err)
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, cf := range configFields {
+		known[cf.path] = true
+		// parents of the field are objects
+		for p := cf.path; strings.Contains(p, "."); {
+			p = p[:strings.LastIndex(p, ".")]
+			known[p+"."] = true
+		}
+	}
+
+	out := map[string]string{}
+	if err = flattenConfig("", m, known, out); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return out, nil
+}
+
+func flattenConfig(prefix string, m map[string]interface{}, known map[string]bool, out map[string]string) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := prefix + k
+
+		switch v := m[k].(type) {
+		case map[string]interface{}:
+			if !known[p+"."] {
+				return fmt.Errorf("%s: unknown field", p)
+			}
+			if err := flattenConfig(p+".", v, known, out); err != nil {
+				return err
+			}
+			continue
+
+		case string:
+			out[p] = v
+		case bool:
+			out[p] = strconv.FormatBool(v)
+		case json.Number:
+			out[p] = v.String()
+		default:
+			return fmt.Errorf("%s: expected a string, number or bool", p)
+		}
+
+		if !known[p] {
+			return fmt.Errorf("%s: unknown field", p)
+		}
+	}
+	return nil
+}
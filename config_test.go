@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "voletc-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func Test_applySettings(t *testing.T) {
+	path := testConfigFile(t, `{
+  "backend": {"uri": "consul://config:8500", "prefix": "from-config"},
+  "dir": "/srv",
+  "server": {"trash_ttl": "1h", "cleanup": true}
+}`)
+	defer os.Remove(path)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	uri := fs.String("H", defaultConsulUri, "")
+	prefix := fs.String("prefix", driverName, "")
+	dir := fs.String("dir", defaultBaseDir, "")
+	ttl := fs.Duration("trash-ttl", defaultTrashTTL, "")
+	clean := fs.Bool("cleanup", false, "")
+	if err := fs.Parse([]string{"-config", path, "-H", "consul://flag:8500"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{"VOLETC_PREFIX": "from-env"}
+	st, err := applySettings(fs, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *uri != "consul://flag:8500" || *prefix != "from-env" || *dir != "/srv" || *ttl != time.Hour || !*clean {
+		t.Errorf("wrong precedence: %s %s %s %v %v", *uri, *prefix, *dir, *ttl, *clean)
+	}
+
+	if err = st.errorf("dir", os.ErrNotExist); !strings.HasPrefix(err.Error(), path+": dir: ") {
+		t.Errorf("should point at the field: %v", err)
+	}
+	if err = st.errorf("prefix", os.ErrNotExist); !strings.HasPrefix(err.Error(), "VOLETC_PREFIX: ") {
+		t.Errorf("should point at the env: %v", err)
+	}
+}
+
+func Test_loadConfigFile_Errors(t *testing.T) {
+	for content, exp := range map[string]string{
+		`{"server": {"listn": "x"}}`:        "server.listn: unknown field",
+		`{"dir": ["/opt"]}`:                 "dir: expected a string, number or bool",
+		`{"log": "debug"}`:                  "log: unknown field",
+		"{\n  \"dir\": \"/opt\",\n}":        "line 3",
+		`{"server": {"trash_ttl": "soon"}}`: "server.trash_ttl: invalid value 'soon'",
+	} {
+		path := testConfigFile(t, content)
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("config", path, "")
+		fs.String("dir", defaultBaseDir, "")
+		fs.String("b", "", "")
+		fs.String("log-level", "", "")
+		fs.Duration("trash-ttl", defaultTrashTTL, "")
+
+		_, err := applySettings(fs, func(string) string { return "" })
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Errorf("%s: expected '%s' got %v", content, exp, err)
+		}
+		os.Remove(path)
+	}
+}
+
+func Test_parseBackendUri(t *testing.T) {
+	if typ, addr, err := parseBackendUri("consul://localhost:8500"); err != nil || typ != "consul" || addr != "localhost:8500" {
+		t.Errorf("wrong split: %s %s %v", typ, addr, err)
+	}
+	for _, uri := range []string{"localhost:8500", "://localhost", "consul://", ""} {
+		if _, _, err := parseBackendUri(uri); err == nil {
+			t.Errorf("%s: should be invalid", uri)
+		}
+	}
+	if d := NewDriverConfig("localhost", "/tmp", "voletc"); d.BackendType != "" {
+		t.Errorf("invalid uri should leave the type empty: %s", d.BackendType)
+	}
+}
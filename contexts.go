@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Output formats of the CLI
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// Context is a named set of client settings e.g. the backend and prefix of a
+// cluster
+type Context struct {
+	Backend string `json:"backend,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// Context settings and the flags they set
+var contextFields = []struct {
+	key  string
+	flag string
+	get  func(*Context) string
+}{
+	{"backend", "H", func(c *Context) string { return c.Backend }},
+	{"prefix", "prefix", func(c *Context) string { return c.Prefix }},
+	{"key_file", "key-file", func(c *Context) string { return c.KeyFile }},
+	{"output", "o", func(c *Context) string { return c.Output }},
+}
+
+// Set a field of the context given as <key>=<value>
+func (c *Context) set(kv string) error {
+	i := strings.Index(kv, "=")
+	if i < 1 {
+		return fmt.Errorf("invalid context setting: '%s'", kv)
+	}
+	k, v := kv[:i], kv[i+1:]
+
+	switch k {
+	case "backend":
+		if !strings.Contains(v, "://") {
+			return fmt.Errorf("invalid backend: '%s' expected <type>://<addr>", v)
+		}
+		c.Backend = v
+	case "prefix":
+		c.Prefix = v
+	case "key_file":
+		c.KeyFile = v
+	case "output":
+		if v != OutputTable && v != OutputJSON {
+			return fmt.Errorf("invalid output: '%s' expected table or json", v)
+		}
+		c.Output = v
+	default:
+		return fmt.Errorf("unknown context setting: '%s'", k)
+	}
+	return nil
+}
+
+// ContextConfig is the client config file holding the contexts and the one in
+// use
+type ContextConfig struct {
+	Current  string              `json:"current,omitempty"`
+	Contexts map[string]*Context `json:"contexts"`
+
+	path string
+}
+
+// Client config file in the home directory
+func defaultContextConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".voletc", "config")
+}
+
+// Empty client config saved to path
+func NewContextConfig(path string) *ContextConfig {
+	return &ContextConfig{Contexts: map[string]*Context{}, path: path}
+}
+
+// Load the client config.  A missing file is an empty config.
+func LoadContextConfig(path string) (*ContextConfig, error) {
+	cc := NewContextConfig(path)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cc, nil
+		}
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, cc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cc.Contexts == nil {
+		cc.Contexts = map[string]*Context{}
+	}
+	return cc, nil
+}
+
+func (cc *ContextConfig) Save() error {
+	b, err := json.MarshalIndent(cc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(cc.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cc.path, b, 0600)
+}
+
+// Context by name or the current one if name is empty.  It returns nil if no
+// context is in use.
+func (cc *ContextConfig) Context(name string) (*Context, error) {
+	if name == "" {
+		name = cc.Current
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	ctx, ok := cc.Contexts[name]
+	if !ok {
+		return nil, fmt.Errorf("context not found: '%s'", name)
+	}
+	return ctx, nil
+}
+
+// Add or update a context with the given <key>=<value> settings
+func (cc *ContextConfig) Add(name string, kvs []string) error {
+	if name == "" || strings.Contains(name, "=") {
+		return fmt.Errorf("invalid context name: '%s'", name)
+	}
+
+	ctx, ok := cc.Contexts[name]
+	if !ok {
+		ctx = &Context{}
+	}
+	for _, kv := range kvs {
+		if err := ctx.set(kv); err != nil {
+			return err
+		}
+	}
+
+	cc.Contexts[name] = ctx
+	return cc.Save()
+}
+
+func (cc *ContextConfig) Use(name string) error {
+	if _, ok := cc.Contexts[name]; !ok {
+		return fmt.Errorf("context not found: '%s'", name)
+	}
+	cc.Current = name
+	return cc.Save()
+}
+
+// Remove a context.  Removing the current one leaves no context in use.
+func (cc *ContextConfig) Remove(name string) error {
+	if _, ok := cc.Contexts[name]; !ok && name != cc.Current {
+		return fmt.Errorf("context not found: '%s'", name)
+	}
+	delete(cc.Contexts, name)
+	if cc.Current == name {
+		cc.Current = ""
+	}
+	return cc.Save()
+}
+
+// Names of the contexts in sorted order
+func (cc *ContextConfig) Names() []string {
+	out := make([]string, 0, len(cc.Contexts))
+	for k := range cc.Contexts {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Apply the context to the flags not given as flags or environment variables.
+// The context takes precedence over the config file.
+func applyContext(fs *flag.FlagSet, st *settings, ctx *Context, name string) error {
+	for _, cf := range contextFields {
+		v := cf.get(ctx)
+		if v == "" || st.explicit[cf.flag] {
+			continue
+		}
+		if err := fs.Set(cf.flag, v); err != nil {
+			return fmt.Errorf("context %s: %s: invalid value '%s': %v", name, cf.key, v, err)
+		}
+		st.sources[cf.flag] = "context " + name + ": " + cf.key
+	}
+	return nil
+}
+
+// Run the context command i.e. context [ls], context use <name>, context add
+// <name> [key=value] or context rm <name>
+func runContextCmd(cc *ContextConfig, args []string) error {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+
+	switch args[0] {
+	case "ls":
+		printContextTable(cc)
+		return nil
+
+	case "use":
+		if len(args) < 2 {
+			return fmt.Errorf("context name required")
+		}
+		if err := cc.Use(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Using context (%s)\n", args[1])
+		return nil
+
+	case "add":
+		if len(args) < 2 {
+			return fmt.Errorf("context name required")
+		}
+		if err := cc.Add(args[1], args[2:]); err != nil {
+			return err
+		}
+		fmt.Printf("Saved context (%s)\n", args[1])
+		return nil
+
+	case "rm":
+		if len(args) < 2 {
+			return fmt.Errorf("context name required")
+		}
+		if err := cc.Remove(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Removed context (%s)\n", args[1])
+		return nil
+	}
+
+	return fmt.Errorf("context command invalid: '%s'", args[0])
+}
+
+func printContextTable(cc *ContextConfig) {
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"current", "name", "backend", "prefix", "key file", "output"})
+
+	for _, name := range cc.Names() {
+		ctx := cc.Contexts[name]
+		cur := ""
+		if name == cc.Current {
+			cur = "*"
+		}
+		tw.Append([]string{cur, name, ctx.Backend, ctx.Prefix, ctx.KeyFile, ctx.Output})
+	}
+
+	tw.SetHeaderLine(false)
+	tw.SetColumnSeparator("")
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(false)
+	tw.Render()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ContextConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voletc-contexts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".voletc", "config")
+
+	cc, err := LoadContextConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx, _ := cc.Context(""); ctx != nil {
+		t.Fatal("no context should be in use")
+	}
+
+	if err = cc.Add("prod", []string{"backend=consul://prod:8500", "prefix=cfg", "output=json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cc.Add("dev", []string{"backend=localhost"}); err == nil {
+		t.Error("should fail for invalid backend")
+	}
+	if err = cc.Add("dev", []string{"color=blue"}); err == nil {
+		t.Error("should fail for unknown setting")
+	}
+	if err = cc.Use("dev"); err == nil {
+		t.Error("should fail for missing context")
+	}
+	if err = cc.Use("prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cc, err = LoadContextConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := cc.Context("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Backend != "consul://prod:8500" || ctx.Prefix != "cfg" || ctx.Output != OutputJSON {
+		t.Fatalf("not saved: %+v", ctx)
+	}
+
+	// flags take precedence over the context
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	uri := fs.String("H", defaultConsulUri, "")
+	prefix := fs.String("prefix", driverName, "")
+	fs.String("key-file", "", "")
+	output := fs.String("o", OutputTable, "")
+	if err = fs.Parse([]string{"-prefix", "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := applySettings(fs, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = applyContext(fs, st, ctx, "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if *uri != "consul://prod:8500" || *prefix != "other" || *output != OutputJSON {
+		t.Errorf("wrong precedence: %s %s %s", *uri, *prefix, *output)
+	}
+
+	if err = runContextCmd(cc, []string{"rm", "dev"}); err == nil {
+		t.Error("should fail for missing context")
+	}
+	if err = runContextCmd(cc, []string{"rm", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if cc, err = LoadContextConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.Contexts) != 0 || cc.Current != "" {
+		t.Errorf("not removed: %+v", cc)
+	}
+}
+
+func Test_ContextConfig_Dangling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voletc-contexts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+
+	if err = ioutil.WriteFile(path, []byte(`{"current": "gone", "contexts": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := LoadContextConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cc.Context(""); err == nil {
+		t.Error("should fail for missing current context")
+	}
+	// a dangling current context can still be removed
+	if err = cc.Remove("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx, err := cc.Context(""); err != nil || ctx != nil {
+		t.Errorf("no context should be in use: %v %v", ctx, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+)
+
+// Parts of a volume to copy
+const (
+	// Env keys and metadata
+	CopyKeys = 1 << iota
+	// Env templates and files
+	CopyTemplates
+	// App and version keys, the app metadata, the schema and the templates
+	// and files of the version which are shared with the other envs of the
+	// destination.  Only copied along with keys or templates respectively.
+	CopyShared
+
+	CopyAll = CopyKeys | CopyTemplates
+)
+
+// Copy the keys and/or templates of src to the in mem datastructure.  Env
+// keys and env templates are copied to the env of the volume.  The parent is
+// only copied within the same version as the parent env does not necessarily
+// exist in other versions.  Overrides are set after the copied data.  Nothing
+// is written to the backend until Commit is called.
+func (a *AppConfig) CopyFrom(src *AppConfig, what int, overrides map[string][]byte) error {
+	data := map[string][]byte{}
+	for k, v := range src.snapshot() {
+		tk := strings.TrimPrefix(k, ScopeEnv+":")
+		isTemplate := strings.HasPrefix(tk, "template:") || strings.HasPrefix(tk, "file:")
+		isShared := isSharedOption(k)
+
+		switch {
+		case isTemplate && what&CopyTemplates == 0,
+			!isTemplate && what&CopyKeys == 0,
+			isShared && what&CopyShared == 0,
+			k == "meta:parent" && (src.Name != a.Name || src.Version != a.Version):
+			continue
+		}
+
+		key, err := optionStorageKey(k)
+		if err != nil {
+			return err
+		}
+		data[key] = v
+	}
+
+	if err := a.Set(data); err != nil {
+		return err
+	}
+	return a.Set(overrides)
+}
+
+// Whether a key in the format of the command line belongs to data shared with
+// other envs i.e. app and version keys, the app metadata, the schema and the
+// templates and files of the version
+func isSharedOption(k string) bool {
+	return strings.HasPrefix(k, ScopeApp+":") || strings.HasPrefix(k, ScopeVersion+":") ||
+		strings.HasPrefix(k, "meta:app:") || k == "meta:schema" ||
+		strings.HasPrefix(k, "template:") || strings.HasPrefix(k, "file:")
+}
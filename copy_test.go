@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_AppConfig_CopyFrom(t *testing.T) {
+	opts, err := parseCreateReqOptions(map[string]string{
+		"db/host":                  "127.0.0.1",
+		"version:db/port":          "5432",
+		"template:config.json":     `{"host": "${db/host}"}`,
+		"env:template:config.json": `{}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, _ := NewAppConfigFromName("copy-0.1.0-staging", nil)
+	src.Set(opts)
+
+	src.Parent = "staging-base"
+
+	dst, _ := NewAppConfigFromName("copy-0.1.1-prod", nil)
+	if err = dst.CopyFrom(src, CopyAll, map[string][]byte{"db/host": []byte("10.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(dst.Keys["db/host"]) != "10.0.0.1" {
+		t.Errorf("override not applied: %s", dst.Keys["db/host"])
+	}
+	if len(dst.VersionKeys) != 0 {
+		t.Errorf("version keys should only be copied with CopyShared")
+	}
+	if dst.Parent != "" {
+		t.Errorf("parent should not be copied to another version: %s", dst.Parent)
+	}
+	if len(dst.Templates) != 0 {
+		t.Errorf("version templates should only be copied with CopyShared: %+v", dst.Templates)
+	}
+	if len(dst.EnvTemplates) != 1 || dst.EnvTemplates[0].Env != "prod" {
+		t.Errorf("templates not copied to env: %+v", dst.EnvTemplates)
+	}
+
+	keys, _ := NewAppConfigFromName("copy-0.1.1-dev", nil)
+	keys.CopyFrom(src, CopyKeys, nil)
+	if len(keys.Templates) != 0 || len(keys.EnvTemplates) != 0 || string(keys.Keys["db/host"]) != "127.0.0.1" {
+		t.Errorf("should only copy keys: %+v", keys)
+	}
+
+	shared, _ := NewAppConfigFromName("copy-0.1.0-prod", nil)
+	shared.CopyFrom(src, CopyAll|CopyShared, nil)
+	if string(shared.VersionKeys["db/port"]) != "5432" || shared.Parent != "staging-base" || len(shared.Templates) != 1 {
+		t.Errorf("version keys, templates and parent should be copied: %+v", shared)
+	}
+
+	tmpls, _ := NewAppConfigFromName("copy-0.1.1-qa", nil)
+	tmpls.CopyFrom(src, CopyTemplates|CopyShared, nil)
+	if len(tmpls.Templates) != 1 || len(tmpls.VersionKeys) != 0 || len(tmpls.Keys["db/host"]) != 0 {
+		t.Errorf("should only copy templates: %+v", tmpls)
+	}
+}
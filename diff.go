@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Number of unchanged lines shown around changes in unified diffs
+const diffContext = 3
+
+// Largest number of line pairs compared when diffing the lines that differ
+// between two bodies.  Larger bodies are only reported to differ.
+const maxDiffCells = 4 << 20
+
+const secretMask = "****"
+
+// Keys whose values are masked in diffs i.e. keys whose last part is one of
+// the words below e.g. db/password, api_token or tls/private-key but not
+// monkey or keyboard/layout
+var secretKeyRe = regexp.MustCompile(`(?i)(^|[/._-])(pass|passwd|password|secrets?|tokens?|credentials?|key)$`)
+
+func isSecretKey(k string) bool {
+	return secretKeyRe.MatchString(k)
+}
+
+// Change types
+const (
+	diffAdded   = "+"
+	diffRemoved = "-"
+	diffChanged = "~"
+)
+
+type KeyDiff struct {
+	Key    string
+	Change string
+	Old    string
+	New    string
+}
+
+type TemplateDiff struct {
+	Name   string
+	Change string
+	// Unified diff of the bodies
+	Diff string
+}
+
+// VolumeDiff contains the differences in effective keys, templates and
+// optionally rendered output between two volumes or revisions
+type VolumeDiff struct {
+	A string
+	B string
+
+	Keys      []*KeyDiff
+	Templates []*TemplateDiff
+	Rendered  []*TemplateDiff
+}
+
+func (vd *VolumeDiff) Empty() bool {
+	return len(vd.Keys) == 0 && len(vd.Templates) == 0 && len(vd.Rendered) == 0
+}
+
+// Diff the in mem datastructures of two volumes.  Secret values are masked
+// unless showSecrets is set.
+func DiffVolumes(a, b *AppConfig, rendered, showSecrets bool) (*VolumeDiff, error) {
+	vd := &VolumeDiff{A: a.QualifiedName(), B: b.QualifiedName()}
+
+	ak, _ := a.EffectiveKeys()
+	bk, _ := b.EffectiveKeys()
+
+	mask := func(k string, v []byte) string {
+		if !showSecrets && isSecretKey(k) && len(v) > 0 {
+			return secretMask
+		}
+		return string(v)
+	}
+
+	for _, k := range unionKeys(ak, bk) {
+		av, inA := ak[k]
+		bv, inB := bk[k]
+
+		switch {
+		case !inA:
+			vd.Keys = append(vd.Keys, &KeyDiff{Key: k, Change: diffAdded, New: mask(k, bv)})
+		case !inB:
+			vd.Keys = append(vd.Keys, &KeyDiff{Key: k, Change: diffRemoved, Old: mask(k, av)})
+		case !bytes.Equal(av, bv):
+			vd.Keys = append(vd.Keys, &KeyDiff{Key: k, Change: diffChanged, Old: mask(k, av), New: mask(k, bv)})
+		}
+	}
+
+	at, bt := templatesByName(a), templatesByName(b)
+	vd.Templates = diffTemplates(at, bt, true)
+
+	if rendered {
+		ar, br := a.renderKeys(), b.renderKeys()
+		for _, td := range diffTemplates(at, bt, false) {
+			ab, err := renderMasked(at[td.Name], ar, showSecrets)
+			if err != nil {
+				return nil, err
+			}
+			bb, err := renderMasked(bt[td.Name], br, showSecrets)
+			if err != nil {
+				return nil, err
+			}
+
+			if td.Diff = unifiedDiff("a/"+td.Name, "b/"+td.Name, ab, bb); td.Diff != "" {
+				vd.Rendered = append(vd.Rendered, td)
+			}
+		}
+	}
+
+	return vd, nil
+}
+
+// Diff template bodies by name.  Without withBody all templates are returned
+// without a diff.
+func diffTemplates(at, bt map[string]*Template, withBody bool) []*TemplateDiff {
+	names := map[string]bool{}
+	for n := range at {
+		names[n] = true
+	}
+	for n := range bt {
+		names[n] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	out := []*TemplateDiff{}
+	for _, n := range sorted {
+		a, inA := at[n]
+		b, inB := bt[n]
+
+		td := &TemplateDiff{Name: n, Change: diffChanged}
+		switch {
+		case !inA:
+			td.Change = diffAdded
+		case !inB:
+			td.Change = diffRemoved
+		case withBody && a.Sha1 == b.Sha1:
+			continue
+		}
+
+		if !withBody {
+			out = append(out, td)
+			continue
+		}
+
+		if (inA && a.Static) || (inB && b.Static) {
+			td.Diff = "binary files differ\n"
+		} else {
+			var ab, bb []byte
+			if inA {
+				ab = a.Body
+			}
+			if inB {
+				bb = b.Body
+			}
+			td.Diff = unifiedDiff("a/"+n, "b/"+n, ab, bb)
+		}
+		out = append(out, td)
+	}
+
+	return out
+}
+
+// Render a template masking secret values.  Static files are not rendered and
+// are left out.
+func renderMasked(t *Template, keys map[string]string, showSecrets bool) ([]byte, error) {
+	if t == nil || t.Static {
+		return nil, nil
+	}
+
+	if !showSecrets {
+		keys = maskSecrets(keys)
+	}
+	return t.Render(keys)
+}
+
+func templatesByName(ac *AppConfig) map[string]*Template {
+	out := map[string]*Template{}
+	for _, t := range ac.ActiveTemplates() {
+		out[t.Name] = t
+	}
+	return out
+}
+
+func unionKeys(a, b ConfigKeys) []string {
+	m := map[string]bool{}
+	for k := range a {
+		m[k] = true
+	}
+	for k := range b {
+		m[k] = true
+	}
+
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Copy of the keys with the values of secret keys masked so they are masked
+// where the template references them
+func maskSecrets(keys map[string]string) map[string]string {
+	out := make(map[string]string, len(keys))
+	for k, v := range keys {
+		if v != "" && isSecretKey(k) {
+			v = secretMask
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func (vd *VolumeDiff) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", vd.A, vd.B)
+
+	if len(vd.Keys) > 0 {
+		buf.WriteString("\nkeys:\n")
+		for _, kd := range vd.Keys {
+			switch kd.Change {
+			case diffAdded:
+				fmt.Fprintf(&buf, "  + %s=%s\n", kd.Key, kd.New)
+			case diffRemoved:
+				fmt.Fprintf(&buf, "  - %s=%s\n", kd.Key, kd.Old)
+			default:
+				fmt.Fprintf(&buf, "  ~ %s: %s -> %s\n", kd.Key, kd.Old, kd.New)
+			}
+		}
+	}
+
+	for _, sec := range []struct {
+		name  string
+		diffs []*TemplateDiff
+	}{{"templates", vd.Templates}, {"rendered", vd.Rendered}} {
+		if len(sec.diffs) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\n%s:\n", sec.name)
+		for _, td := range sec.diffs {
+			fmt.Fprintf(&buf, "  %s %s\n", td.Change, td.Name)
+			for _, l := range strings.SplitAfter(td.Diff, "\n") {
+				if l != "" {
+					buf.WriteString("    " + l)
+				}
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+// Unified diff of a and b by line.  It returns an empty string if they are
+// the same.  Lines the bodies have in common at the start and end are not
+// compared.  If the lines in between are too many to compare, the bodies are
+// only reported to differ.
+func unifiedDiff(aName, bName string, a, b []byte) string {
+	al, bl := splitLines(a), splitLines(b)
+
+	// common prefix and suffix
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre && al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+
+	am, bm := al[pre:len(al)-suf], bl[pre:len(bl)-suf]
+	if len(am) > 0 && len(bm) > 0 && len(am)*len(bm) > maxDiffCells {
+		return fmt.Sprintf("--- %s\n+++ %s\nfiles differ: %d lines changed\n", aName, bName, len(am)+len(bm))
+	}
+
+	// longest common subsequence table of the lines in between
+	lcs := make([][]int, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// edit script: ' ' unchanged, '-' removed from a, '+' added from b
+	type edit struct {
+		op   byte
+		line string
+		ai   int
+		bi   int
+	}
+	edits := []edit{}
+	for i := 0; i < pre; i++ {
+		edits = append(edits, edit{' ', al[i], i, i})
+	}
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			edits = append(edits, edit{' ', am[i], pre + i, pre + j})
+			i++
+			j++
+		case i < len(am) && (j == len(bm) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', am[i], pre + i, pre + j})
+			i++
+		default:
+			edits = append(edits, edit{'+', bm[j], pre + i, pre + j})
+			j++
+		}
+	}
+	for k := 0; k < suf; k++ {
+		edits = append(edits, edit{' ', al[len(al)-suf+k], len(al) - suf + k, len(bl) - suf + k})
+	}
+
+	var buf bytes.Buffer
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+
+		// hunk boundaries including context
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			// stop if the run of unchanged lines is longer than both contexts
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*diffContext {
+				end += diffContext
+				if end > len(edits) {
+					end = len(edits)
+				}
+				break
+			}
+			end = run
+		}
+
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+		}
+
+		acount, bcount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				acount++
+			}
+			if e.op != '-' {
+				bcount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(edits[start].ai, acount), hunkRange(edits[start].bi, bcount))
+
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&buf, "%c%s\n", e.op, e.line)
+		}
+		k = end
+	}
+
+	return buf.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_unifiedDiff(t *testing.T) {
+	if d := unifiedDiff("a", "b", []byte("x\ny\n"), []byte("x\ny\n")); d != "" {
+		t.Errorf("should be empty: %q", d)
+	}
+
+	a := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n")
+	b := []byte("1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11\n")
+
+	exp := `--- a
++++ b
+@@ -2,9 +2,10 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+ 9
+ 10
++11
+`
+	if d := unifiedDiff("a", "b", a, b); d != exp {
+		t.Errorf("got:\n%s", d)
+	}
+
+	d := unifiedDiff("a", "b", nil, []byte("x\n"))
+	if !strings.Contains(d, "@@ -0,0 +1 @@\n+x\n") {
+		t.Errorf("got:\n%s", d)
+	}
+}
+
+func Test_DiffVolumes(t *testing.T) {
+	mk := func(name string, m map[string]string) *AppConfig {
+		opts, err := parseCreateReqOptions(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac, _ := NewAppConfigFromName(name, nil)
+		if err = ac.Set(opts); err != nil {
+			t.Fatal(err)
+		}
+		return ac
+	}
+
+	a := mk("diff-0.1.0-staging", map[string]string{
+		"db/host":              "staging",
+		"db/password":          "s3cret",
+		"old":                  "x",
+		"template:config.json": `{"host": "${db/host}", "pass": "${db/password}"}`,
+	})
+	b := mk("diff-0.1.0-prod", map[string]string{
+		"db/host":              "prod",
+		"db/password":          "t0psecret",
+		"new":                  "y",
+		"template:config.json": `{"host": "${db/host}", "pass": "${db/password}"}`,
+	})
+
+	vd, err := DiffVolumes(a, b, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := map[string]*KeyDiff{}
+	for _, kd := range vd.Keys {
+		changes[kd.Key] = kd
+	}
+	if kd := changes["db/host"]; kd == nil || kd.Change != diffChanged || kd.New != "prod" {
+		t.Errorf("db/host: %+v", kd)
+	}
+	if kd := changes["db/password"]; kd == nil || kd.Old != secretMask || kd.New != secretMask {
+		t.Errorf("db/password should be masked: %+v", kd)
+	}
+	if kd := changes["old"]; kd == nil || kd.Change != diffRemoved {
+		t.Errorf("old: %+v", kd)
+	}
+	if kd := changes["new"]; kd == nil || kd.Change != diffAdded {
+		t.Errorf("new: %+v", kd)
+	}
+
+	if len(vd.Templates) != 0 {
+		t.Errorf("templates should not differ: %+v", vd.Templates)
+	}
+	if len(vd.Rendered) != 1 {
+		t.Fatalf("rendered should differ: %+v", vd.Rendered)
+	}
+
+	s := vd.String()
+	if strings.Contains(s, "s3cret") || strings.Contains(s, "t0psecret") {
+		t.Errorf("secrets not masked:\n%s", s)
+	}
+
+	if vd, _ = DiffVolumes(a, b, true, true); !strings.Contains(vd.String(), "t0psecret") {
+		t.Errorf("secrets should be shown:\n%s", vd.String())
+	}
+
+	if vd, _ = DiffVolumes(a, a, true, false); !vd.Empty() {
+		t.Errorf("should be empty:\n%s", vd.String())
+	}
+}
+
+func Test_unifiedDiff_Large(t *testing.T) {
+	var a, b bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&a, "a%d\n", i)
+		fmt.Fprintf(&b, "b%d\n", i)
+	}
+
+	d := unifiedDiff("a", "b", a.Bytes(), b.Bytes())
+	if !strings.Contains(d, "files differ") {
+		t.Errorf("should only report a difference:\n%.200s", d)
+	}
+
+	// a small change in a large body is still diffed
+	c := bytes.Replace(a.Bytes(), []byte("a1500\n"), []byte("x\n"), 1)
+	if d = unifiedDiff("a", "c", a.Bytes(), c); !strings.Contains(d, "@@ -1498,7 +1498,7 @@\n") || !strings.Contains(d, "-a1500\n+x\n") {
+		t.Errorf("got:\n%s", d)
+	}
+}
+
+func Test_isSecretKey(t *testing.T) {
+	for k, exp := range map[string]bool{
+		"db/password":     true,
+		"api_token":       true,
+		"tls/private-key": true,
+		"aws.secret":      true,
+		"key":             true,
+		"monkey":          false,
+		"keyboard/layout": false,
+		"db/passenger":    false,
+		"cache/key_count": false,
+	} {
+		if isSecretKey(k) != exp {
+			t.Errorf("%s: want %v", k, exp)
+		}
+	}
+}
+
+func Test_maskSecrets(t *testing.T) {
+	tmpl := NewTemplateFromKey("templates/t")
+	tmpl.SetBody([]byte(`mode=${mode} pass=${db/password}`))
+
+	// the value of the secret also appears elsewhere
+	out, err := renderMasked(tmpl, map[string]string{"mode": "a", "db/password": "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "mode=a pass="+secretMask {
+		t.Errorf("got: %s", out)
+	}
+}
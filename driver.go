@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
@@ -14,23 +16,45 @@ import (
 const (
 	driverScope = "global"
 	driverName  = "voletc"
+
+	defaultTrashTTL    = 7 * 24 * time.Hour
+	defaultCacheMaxAge = 24 * time.Hour
+	// How often expired volumes are purged from the trash
+	trashPurgeInterval = time.Hour
 )
 
+var errShuttingDown = fmt.Errorf("shutting down")
+
 type DriverConfig struct {
 	MountBaseDir  string
 	BackendType   string
 	BackendAddr   string
 	Prefix        string
 	EncryptionKey string
+	// Values larger than this are split into chunks
+	ChunkSize int
+	// What Remove does with the volume data (see RemoveRetain, RemoveTrash and
+	// RemoveDestroy) and how long trashed volumes are kept
+	RemovePolicy string
+	TrashTTL     time.Duration
+	// How long the local copy of a volume may be served while the backend is
+	// unavailable.  0 disables the cache as does the lack of an encryption key.
+	CacheMaxAge time.Duration
 }
 
+// An invalid backend uri results in an empty backend type which NewBackend
+// refuses.  Use parseBackendUri to validate it beforehand.
 func NewDriverConfig(backendUri, basedir, prefix string) *DriverConfig {
-	idx := strings.Index(backendUri, "://")
+	typ, addr, _ := parseBackendUri(backendUri)
 	d := &DriverConfig{
 		MountBaseDir: filepath.Join(basedir, prefix),
-		BackendType:  backendUri[:idx],
-		BackendAddr:  backendUri[idx+3:],
+		BackendType:  typ,
+		BackendAddr:  addr,
 		Prefix:       prefix,
+		ChunkSize:    defaultChunkSize,
+		RemovePolicy: RemoveRetain,
+		TrashTTL:     defaultTrashTTL,
+		CacheMaxAge:  defaultCacheMaxAge,
 	}
 
 	if !strings.HasSuffix(d.MountBaseDir, "/") {
@@ -40,51 +64,235 @@ func NewDriverConfig(backendUri, basedir, prefix string) *DriverConfig {
 	return d
 }
 
+// Split a backend uri e.g. consul://127.0.0.1:8500 into its type and address
+func parseBackendUri(uri string) (string, string, error) {
+	idx := strings.Index(uri, "://")
+	if idx < 1 || idx+3 == len(uri) {
+		return "", "", fmt.Errorf("invalid backend uri, expected <type>://<address>: '%s'", uri)
+	}
+	return uri[:idx], uri[idx+3:], nil
+}
+
 type MyVolumeDriver struct {
 	cfg *DriverConfig
 
 	ve *VolEtc
 
 	be Backend
+
+	// Volumes pinned to a revision on this node
+	pins *revisionPins
+	// Volumes mounted on this node
+	mounts *mountTable
+	// Copies of volumes served while the backend is unavailable
+	cache *volumeCache
+
+	// Requests in flight and whether new ones are refused
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+	stopping bool
 }
 
 func NewVolumeDriver(cfg *DriverConfig) (*MyVolumeDriver, error) {
 	d := &MyVolumeDriver{cfg: cfg}
 	os.MkdirAll(d.cfg.MountBaseDir, 0777)
 
+	d.pins = newRevisionPins(filepath.Join(cfg.MountBaseDir, ".pins.json"))
+	if err := d.pins.load(); err != nil {
+		return nil, err
+	}
+
+	// An unreadable table is started over, leaving the mountpoints in place
+	d.mounts = newMountTable(filepath.Join(cfg.MountBaseDir, ".mounts.json"))
+	if err := d.mounts.load(); err != nil {
+		logger.Warn("ignoring invalid mount table, leaving mountpoints in place", "err", err)
+	}
+
+	// Without a key the cached copies of the volumes can't be protected
+	cacheDir := filepath.Join(cfg.MountBaseDir, ".cache")
+	if cfg.CacheMaxAge > 0 && cfg.EncryptionKey != "" {
+		var err error
+		if d.cache, err = newVolumeCache(cacheDir, cfg.EncryptionKey, cfg.CacheMaxAge); err != nil {
+			return nil, err
+		}
+	} else {
+		if cfg.CacheMaxAge > 0 {
+			logger.Info("offline cache disabled, it requires an encryption key")
+		}
+		// copies left by earlier runs
+		os.RemoveAll(cacheDir)
+	}
+
 	be, err := NewBackend(cfg)
-	if err == nil {
-		d.be = be
-		d.ve = &VolEtc{be}
+	if err != nil {
+		return d, err
+	}
+	d.be = be
+	d.ve = &VolEtc{be: be, source: "docker"}
+
+	d.reconcileMounts()
+
+	return d, nil
+}
+
+// Refuse new requests and wait up to timeout for the ones in flight to finish.
+// The rendered files of mounted volumes are removed if cleanup is set.
+func (m *MyVolumeDriver) Shutdown(timeout time.Duration, cleanup bool) error {
+	m.mu.Lock()
+	m.stopping = true
+	m.mu.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out waiting for requests after %v", timeout)
+	}
+
+	if cleanup {
+		m.cleanupMounts()
+	}
+	return err
+}
+
+// Track a request so shutdown can wait for it.  Requests are refused once
+// shutdown has started.
+func (m *MyVolumeDriver) acquire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopping {
+		return errShuttingDown
+	}
+	m.inflight.Add(1)
+	return nil
+}
+
+func (m *MyVolumeDriver) release() {
+	m.inflight.Done()
+}
+
+func (m *MyVolumeDriver) isStopping() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopping
+}
+
+// Purge expired volumes from the trash every interval until shutdown
+func (m *MyVolumeDriver) purgeTrash(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for now := range t.C {
+		if m.isStopping() {
+			return
+		}
+		if n, err := m.ve.PurgeTrash(now); err != nil {
+			logger.Warn("purging trash failed", "err", err)
+		} else if n > 0 {
+			logger.Info("purged trash", "volumes", n)
+		}
 	}
+}
+
+// Prefix read to check the backend can be reached
+const healthPrefix = ".health/"
 
-	return d, err
+// Check the backend can be reached
+func (m *MyVolumeDriver) checkBackend() error {
+	_, err := m.be.GetMap(healthPrefix)
+	return err
 }
 
 // Instruct the plugin that the user wants to create a volume, given a user specified
 // volume name. The plugin does not need to actually manifest the volume on the
 // filesystem yet (until Mount is called). Opts is a map of driver specific options
 // passed through from the user request.
-func (m *MyVolumeDriver) Create(req volume.Request) volume.Response {
-	log.Printf("[Create] Request: %+v\n", req)
+func (m *MyVolumeDriver) create(lg *Logger, req volume.Request) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
+
 	// Create kv structure on backend.
 
-	_, err := m.ve.Get(req.Name)
+	opts, rev, err := parseRevisionOption(req.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	// Aliases and version ranges refer to existing volumes
+	resolved, err := m.ve.Resolve(req.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if resolved != req.Name {
+		switch {
+		case len(opts) > 0:
+			return volume.Response{Err: "options not supported for alias: " + req.Name}
+		case rev > 0:
+			return m.pinRevision(lg, req.Name, rev)
+		}
+		return volume.Response{}
+	}
+
+	_, err = m.ve.Get(req.Name)
 	if err == nil {
+		// Pin an existing volume to a revision
+		if rev > 0 && len(opts) == 0 {
+			return m.pinRevision(lg, req.Name, rev)
+		}
 		return volume.Response{Err: "exists: " + req.Name}
 	}
+	if rev > 0 {
+		return volume.Response{Err: "revision requires an existing volume: " + req.Name}
+	}
+
+	// Copy an existing volume.  Data shared with the other envs of the
+	// destination is only copied with shared=true.
+	var src *AppConfig
+	what := CopyAll
+	if from, ok := opts["from"]; ok {
+		delete(opts, "from")
+		if src, err = m.ve.Get(from); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		if opts["shared"] == "true" {
+			what |= CopyShared
+		}
+		delete(opts, "shared")
+	}
 
 	c, err := NewAppConfigFromName(req.Name, m.be)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
+	c.source, c.lg = "docker", lg
+
+	// The volume would not be listed under the name it was created with
+	if _, err = volumeNaming.DockerName(c.Name, c.Version, c.Env); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
 
-	mp, err := parseCreateReqOptions(req.Options)
+	mp, err := parseCreateReqOptions(opts)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	c.Set(mp)
+	if src != nil {
+		err = c.CopyFrom(src, what, mp)
+	} else {
+		err = c.Set(mp)
+	}
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
 
 	if err = c.Commit(); err != nil {
 		return volume.Response{Err: err.Error()}
@@ -94,35 +302,63 @@ func (m *MyVolumeDriver) Create(req volume.Request) volume.Response {
 }
 
 // Get the list of volumes registered with the plugin.
-func (m *MyVolumeDriver) List(req volume.Request) volume.Response {
-	log.Printf("[List] Request: %+v\n", req)
+func (m *MyVolumeDriver) list(lg *Logger, req volume.Request) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
 
 	ls, err := m.ve.List()
 	if err != nil {
-		return volume.Response{Err: err.Error()}
+		if m.cache == nil {
+			return volume.Response{Err: err.Error()}
+		}
+		lg.Warn("backend unavailable, listing cached volumes", "err", err)
+		return m.listCached()
 	}
 
 	resp := volume.Response{Capabilities: volume.Capability{Scope: driverScope}}
 
-	resp.Volumes = make([]*volume.Volume, len(ls))
-	i := 0
+	resp.Volumes = make([]*volume.Volume, 0, len(ls))
 	for _, v := range ls {
-		resp.Volumes[i] = &volume.Volume{
-			Name:       v.QualifiedName(),
-			Mountpoint: m.cfg.MountBaseDir + v.getOpaque(v.Env),
+		// volumes created with the cli in the explicit form
+		name, err := volumeNaming.DockerName(v.Name, v.Version, v.Env)
+		if err != nil {
+			lg.Debug("volume not listed", "err", err)
+			continue
 		}
-		i++
+		resp.Volumes = append(resp.Volumes, &volume.Volume{
+			Name:       name,
+			Mountpoint: m.cfg.MountBaseDir + v.getOpaque(v.Env),
+		})
+	}
+
+	return resp
+}
+
+// List the cached volumes flagged as stale
+func (m *MyVolumeDriver) listCached() volume.Response {
+	resp := volume.Response{Capabilities: volume.Capability{Scope: driverScope}}
+
+	for _, e := range m.cache.entries() {
+		resp.Volumes = append(resp.Volumes, &volume.Volume{
+			Name:       e.Volume,
+			Mountpoint: m.mountpoint(e.Volume),
+			Status:     map[string]interface{}{"stale": true, "cached": e.Cached.Format(time.RFC3339)},
+		})
 	}
 
-	log.Printf("[List] Response: %+v", resp)
 	return resp
 }
 
 // Get the volume info.
-func (m *MyVolumeDriver) Get(req volume.Request) volume.Response {
-	log.Printf("[Get] Request: %+v\n", req)
+func (m *MyVolumeDriver) inspect(lg *Logger, req volume.Request) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
 
-	c, err := m.ve.Get(req.Name)
+	c, cached, err := m.get(lg, req.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
@@ -132,61 +368,105 @@ func (m *MyVolumeDriver) Get(req volume.Request) volume.Response {
 	}
 	resp.Volume = &volume.Volume{
 		Name:       req.Name,
-		Mountpoint: m.cfg.MountBaseDir + c.getOpaque(c.Env),
+		Mountpoint: m.mountpoint(req.Name),
 		Status:     c.Metadata(),
 	}
+	if rev := m.pins.get(lg, req.Name, c.QualifiedName()); rev > 0 {
+		resp.Volume.Status["revision"] = rev
+	}
+	if c.QualifiedName() != req.Name {
+		resp.Volume.Status["resolved"] = c.QualifiedName()
+	}
+	if cached != nil {
+		resp.Volume.Status["stale"] = true
+		resp.Volume.Status["cached"] = cached.Cached.Format(time.RFC3339)
+	}
 
-	log.Printf("[Get] Response: %+v\n", resp)
 	return resp
 }
 
 // Delete the specified volume from disk. This request is issued when a user invokes
-// docker rm -v to remove volumes associated with a container.
-func (m *MyVolumeDriver) Remove(req volume.Request) volume.Response {
-	log.Printf("[Remove] Request: %+v\n", req)
+// docker rm -v to remove volumes associated with a container.  The volume data
+// is shared by all nodes so it is only trashed or destroyed in the backend if
+// the remove policy says so.
+func (m *MyVolumeDriver) remove(lg *Logger, req volume.Request) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
+
+	// Removing an alias leaves the volume it points at in place
+	if resolved, err := m.ve.Resolve(req.Name); err == nil && resolved != req.Name {
+		if err = m.pins.set(req.Name, "", 0); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{}
+	}
 
-	c, err := m.ve.Get(req.Name)
+	c, err := m.volEtc(lg).Get(req.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
+	switch m.cfg.RemovePolicy {
+	case RemoveDestroy:
+		err = c.Destroy()
+
+	case RemoveTrash:
+		_, err = c.Trash(m.cfg.TrashTTL)
+
+	}
+	if err == nil && m.cache != nil && m.cfg.RemovePolicy != RemoveRetain {
+		m.cache.remove(req.Name)
+	}
+
 	resp := volume.Response{}
-	if err = c.Destroy(); err != nil {
+	if err != nil {
+		resp.Err = err.Error()
+	} else if err = m.pins.set(req.Name, "", 0); err != nil {
 		resp.Err = err.Error()
 	}
 
-	log.Printf("[Remove] Response: %+v\n", resp)
 	return resp
 }
 
 // Respond with the path on the host filesystem where the volume has been made available,
 // and/or a string error if an error occurred. Mountpoint is optional, however the plugin
 // may be queried again later if one is not provided.
-func (m *MyVolumeDriver) Path(req volume.Request) volume.Response {
-	log.Printf("[Path] Request: %+v\n", req)
+func (m *MyVolumeDriver) path(lg *Logger, req volume.Request) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
 
-	c, err := m.ve.Get(req.Name)
-	if err != nil {
+	if _, _, err := m.get(lg, req.Name); err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	resp := volume.Response{Mountpoint: m.cfg.MountBaseDir + c.getOpaque(c.Env)}
-	log.Printf("[Path] Response: %+v\n", resp)
+	resp := volume.Response{Mountpoint: m.mountpoint(req.Name)}
 	return resp
 }
 
-func (m *MyVolumeDriver) Mount(req volume.MountRequest) volume.Response {
-	log.Printf("Mount: %+v\n", req)
+func (m *MyVolumeDriver) mount(lg *Logger, req volume.MountRequest) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
 
-	c, err := m.ve.Get(req.Name)
+	// Aliases and version ranges are resolved on every mount
+	c, _, err := m.get(lg, req.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	dpath := m.cfg.MountBaseDir + c.getOpaque(c.Env)
+	dpath := m.mountpoint(req.Name)
 
-	if err = os.MkdirAll(dpath, 0777); err == nil {
-		err = c.Generate(dpath)
+	// tracked first so files left by a failed render are removed later
+	if err = m.mounts.track(req.Name); err == nil {
+		err = m.render(lg, c, req.Name, dpath)
+	}
+	if err == nil {
+		err = m.mounts.add(req.Name, req.ID)
 	}
 
 	if err != nil {
@@ -196,52 +476,251 @@ func (m *MyVolumeDriver) Mount(req volume.MountRequest) volume.Response {
 	return volume.Response{Mountpoint: dpath}
 }
 
+// Write the files of the volume to the mountpoint honoring its pinned revision
+func (m *MyVolumeDriver) render(lg *Logger, c *AppConfig, name, dpath string) error {
+	err := os.MkdirAll(dpath, 0777)
+	if err != nil {
+		return err
+	}
+
+	if rev := m.pins.get(lg, name, c.QualifiedName()); rev > 0 {
+		if err = c.LoadRevision(rev, true); err == nil {
+			// include the revision in the cached copy
+			m.cacheVolume(name, c)
+			err = c.WriteFiles(dpath)
+		}
+	} else {
+		err = c.Generate(dpath)
+	}
+
+	if err != nil {
+		renderFailures.inc("")
+	}
+	return err
+}
+
 // Indication that Docker no longer is using the named volume. This is called
 // once per container stop. Plugin may deduce that it is safe to deprovision it at this point.
-func (m *MyVolumeDriver) Unmount(req volume.UnmountRequest) volume.Response {
-	log.Printf("[Unmount] Request: %+v\n", req)
+func (m *MyVolumeDriver) unmount(lg *Logger, req volume.UnmountRequest) volume.Response {
+	if err := m.acquire(); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	defer m.release()
 
-	c, err := m.ve.Get(req.Name)
-	if err != nil {
+	if _, _, err := m.get(lg, req.Name); err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	dpath := m.cfg.MountBaseDir + c.getOpaque(c.Env)
-	os.RemoveAll(dpath)
+	// the files stay until the last mount using the volume is gone
+	n, err := m.mounts.remove(req.Name, req.ID)
+	if n == 0 && os.RemoveAll(m.mountpoint(req.Name)) == nil && err == nil {
+		err = m.mounts.untrack(req.Name)
+	}
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
 
 	return volume.Response{}
 }
 
+// Endpoints of the volume.Driver interface.  The instrumentedDriver calls the
+// endpoints with a logger carrying the id of the request instead.
+func (m *MyVolumeDriver) Create(req volume.Request) volume.Response { return m.create(logger, req) }
+func (m *MyVolumeDriver) List(req volume.Request) volume.Response   { return m.list(logger, req) }
+func (m *MyVolumeDriver) Get(req volume.Request) volume.Response    { return m.inspect(logger, req) }
+func (m *MyVolumeDriver) Remove(req volume.Request) volume.Response { return m.remove(logger, req) }
+func (m *MyVolumeDriver) Path(req volume.Request) volume.Response   { return m.path(logger, req) }
+func (m *MyVolumeDriver) Mount(req volume.MountRequest) volume.Response {
+	return m.mount(logger, req)
+}
+func (m *MyVolumeDriver) Unmount(req volume.UnmountRequest) volume.Response {
+	return m.unmount(logger, req)
+}
+
 // Get the list of capabilities the driver supports. The driver is not required
 // to implement this endpoint, however in such cases the default values will be taken.
 func (m *MyVolumeDriver) Capabilities(req volume.Request) volume.Response {
 	return volume.Response{Capabilities: volume.Capability{Scope: driverScope}}
 }
 
-// convert template:<name> to templates/<name> for storage
+// Get a volume resolving aliases and version ranges.  If the backend is
+// unavailable the copy last loaded is served from the cache along with its
+// cache entry.
+func (m *MyVolumeDriver) get(lg *Logger, name string) (*AppConfig, *cacheEntry, error) {
+	if m.cache == nil {
+		c, err := lookupVolume(m.volEtc(lg), name)
+		return c, nil, err
+	}
+
+	rb := newRecordingBackend(m.be)
+	c, err := lookupVolume(&VolEtc{be: rb, source: m.ve.source, lg: lg}, name)
+	if err == nil {
+		m.cacheVolume(name, c)
+		return c, nil, nil
+	}
+	if rb.err == nil {
+		// the backend is fine e.g. the volume does not exist
+		return nil, nil, err
+	}
+
+	e, cerr := m.cache.get(name)
+	if cerr != nil {
+		lg.Warn("cached volume unavailable", "volume", name, "err", cerr)
+		return nil, nil, err
+	}
+	lg.Warn("backend unavailable, serving cached volume", "volume", name, "cached", e.Cached.Format(time.RFC3339), "err", err)
+	cacheServed.inc("")
+
+	c, err = lookupVolume(&VolEtc{be: &cachedBackend{data: e.Data}, source: m.ve.source, lg: lg}, name)
+	return c, e, err
+}
+
+// Cache the backend data the volume was loaded from
+func (m *MyVolumeDriver) cacheVolume(name string, c *AppConfig) {
+	rb, ok := c.be.(*recordingBackend)
+	if !ok || m.cache == nil {
+		return
+	}
+	if err := m.cache.set(name, volumeData(c, rb.data)); err != nil {
+		c.log().Warn("caching volume failed", "volume", name, "err", err)
+	}
+}
+
+// Volumes logging on behalf of the request
+func (m *MyVolumeDriver) volEtc(lg *Logger) *VolEtc {
+	return &VolEtc{be: m.be, source: m.ve.source, lg: lg}
+}
+
+func lookupVolume(ve *VolEtc, name string) (*AppConfig, error) {
+	resolved, err := ve.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ve.Get(resolved)
+}
+
+// Mountpoint of the volume by the name it was requested with so an alias is
+// not affected by the volume it points at
+func (m *MyVolumeDriver) mountpoint(n string) string {
+	name, version, env, _ := parseAppName(n)
+	return m.cfg.MountBaseDir + name + "/" + version + "/" + env
+}
+
+func (m *MyVolumeDriver) pinRevision(lg *Logger, name string, rev int) volume.Response {
+	c, _, err := m.get(lg, name)
+	if err == nil {
+		// make sure it exists
+		_, err = c.Revision(rev)
+	}
+	if err == nil {
+		err = m.pins.set(name, c.QualifiedName(), rev)
+	}
+
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	return volume.Response{}
+}
+
+// Extract the revision option used to mount a specific revision of the volume.
+// It returns the remaining options.
+func parseRevisionOption(m map[string]string) (map[string]string, int, error) {
+	out := map[string]string{}
+	rev := 0
+
+	for k, v := range m {
+		if k != "revision" {
+			out[k] = v
+			continue
+		}
+
+		var err error
+		if rev, err = strconv.Atoi(v); err != nil || rev < 1 {
+			return nil, 0, fmt.Errorf("invalid revision: '%s'", v)
+		}
+	}
+
+	return out, rev, nil
+}
+
+// convert options to keys for storage (see optionStorageKey).  Template, file
+// and schema values starting with '/' or './' are read from the file system.
 func parseCreateReqOptions(m map[string]string) (map[string][]byte, error) {
 	out := map[string][]byte{}
 	for k, v := range m {
-		if strings.HasPrefix(k, "template:") {
-			l := strings.Index(k, ":") + 1
-			var val []byte
+		key, err := optionStorageKey(k)
+		if err != nil {
+			return nil, err
+		}
 
+		val := []byte(v)
+		if tk := strings.TrimPrefix(key, ScopeEnv+":"); strings.HasPrefix(tk, "templates/") || strings.HasPrefix(tk, "files/") || key == schemaKey {
 			if strings.HasPrefix(v, "/") || strings.HasPrefix(v, "./") {
-				b, err := ioutil.ReadFile(v)
-				if err != nil {
+				if val, err = ioutil.ReadFile(v); err != nil {
 					return nil, err
 				}
-				val = b
-			} else {
-				val = []byte(v)
 			}
-			out["templates/"+k[l:]] = val
-
-		} else if strings.HasPrefix(k, "templates/") {
-			return nil, fmt.Errorf("reserved prefix: 'templates/' in '%s'", k)
-		} else {
-			out[k] = []byte(v)
 		}
+		out[key] = val
 	}
 	return out, nil
 }
+
+// convert template:<name> to templates/<name>, file:<name> to files/<name>,
+// app:<key> or version:<key> to shared/<scope>/<key>, meta:parent,
+// meta:owner, meta:description and meta:label:<label> to .meta/, the same
+// prefixed with meta:app: to .meta/app/ and meta:schema to .schema for
+// storage.  Templates and files prefixed with env:
+// are converted to env:templates/<name> and env:files/<name>.
+func optionStorageKey(k string) (string, error) {
+	// env template overrides i.e. env:template:<name> and env:file:<name>
+	scope := ""
+	if strings.HasPrefix(k, ScopeEnv+":template:") || strings.HasPrefix(k, ScopeEnv+":file:") {
+		scope = ScopeEnv + ":"
+		k = strings.TrimPrefix(k, scope)
+	}
+
+	switch {
+	case strings.HasPrefix(k, "template:"):
+		return scope + "templates/" + strings.TrimPrefix(k, "template:"), nil
+
+	case strings.HasPrefix(k, "file:"):
+		return scope + "files/" + strings.TrimPrefix(k, "file:"), nil
+
+	case strings.HasPrefix(k, ScopeApp+":") || strings.HasPrefix(k, ScopeVersion+":"):
+		// shared keys i.e. app:<key> and version:<key>
+		l := strings.Index(k, ":")
+		return sharedDir + "/" + k[:l] + "/" + k[l+1:], nil
+
+	case k == "meta:parent":
+		return metaDir + "/parent", nil
+
+	case k == "meta:schema":
+		return schemaKey, nil
+
+	case k == "meta:app:owner" || k == "meta:app:description":
+		return appMetaDir + "/" + strings.TrimPrefix(k, "meta:app:"), nil
+
+	case strings.HasPrefix(k, "meta:app:label:") && len(k) > len("meta:app:label:"):
+		return appMetaDir + "/" + labelsDir + "/" + strings.TrimPrefix(k, "meta:app:label:"), nil
+
+	case k == "meta:owner" || k == "meta:description":
+		return metaDir + "/" + strings.TrimPrefix(k, "meta:"), nil
+
+	case strings.HasPrefix(k, "meta:label:") && len(k) > len("meta:label:"):
+		return metaDir + "/" + labelsDir + "/" + strings.TrimPrefix(k, "meta:label:"), nil
+
+	case strings.HasPrefix(k, "meta:"):
+		return "", fmt.Errorf("unknown metadata: '%s'", k)
+
+	case strings.HasPrefix(k, "."):
+		return "", fmt.Errorf("reserved key: '%s'", k)
+
+	case strings.HasPrefix(k, "templates/") || strings.HasPrefix(k, "files/") ||
+		strings.HasPrefix(k, sharedDir+"/") || strings.HasPrefix(k, metaDir+"/"):
+		return "", fmt.Errorf("reserved prefix: '%s/' in '%s'", k[:strings.Index(k, "/")], k)
+
+	}
+
+	return k, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errCacheReadOnly = fmt.Errorf("backend unavailable: cached volumes are read only")
+
+// volumeCache keeps an encrypted copy of the backend data each volume was last
+// loaded from so volumes can still be mounted while the backend is down.
+type volumeCache struct {
+	dir string
+	key []byte
+	// Entries older than this are not used
+	maxAge time.Duration
+
+	// Checksum of the data last written for each volume so unchanged data is
+	// not written again
+	mu      sync.Mutex
+	written map[string][sha256.Size]byte
+}
+
+// cacheEntry is the backend data a volume was loaded from
+type cacheEntry struct {
+	Volume string            `json:"volume"`
+	Cached time.Time         `json:"cached"`
+	Data   map[string][]byte `json:"data"`
+}
+
+// Create the cache under dir.  Entries are encrypted with a key derived from
+// secret which has to be kept outside of dir for the encryption to be of any
+// use.  Expired entries and those that can't be read with the key are removed.
+func newVolumeCache(dir, secret string, maxAge time.Duration) (*volumeCache, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("cache requires an encryption key")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	k := sha256.Sum256([]byte(secret))
+	vc := &volumeCache{dir: dir, key: k[:], maxAge: maxAge, written: map[string][sha256.Size]byte{}}
+
+	// key of earlier versions kept along with the entries
+	os.Remove(filepath.Join(dir, ".key"))
+	vc.entries()
+	return vc, nil
+}
+
+func (vc *volumeCache) path(name string) string {
+	return filepath.Join(vc.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(name))))
+}
+
+// Store the backend data the volume was loaded from.  Data unchanged since
+// the last write is not written again, only the modification time of the
+// entry is bumped which counts as the time it was cached.
+func (vc *volumeCache) set(name string, data map[string][]byte) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	sum, now := sha256.Sum256(b), time.Now().UTC()
+
+	vc.mu.Lock()
+	last, ok := vc.written[name]
+	vc.mu.Unlock()
+	if ok && last == sum && os.Chtimes(vc.path(name), now, now) == nil {
+		return nil
+	}
+
+	if b, err = json.Marshal(&cacheEntry{Volume: name, Cached: now, Data: data}); err != nil {
+		return err
+	}
+	if b, err = encrypt(vc.key, b); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(vc.path(name), b, 0600); err != nil {
+		return err
+	}
+
+	vc.mu.Lock()
+	vc.written[name] = sum
+	vc.mu.Unlock()
+	return nil
+}
+
+// Entry of the volume if it has not expired
+func (vc *volumeCache) get(name string) (*cacheEntry, error) {
+	e, err := vc.read(vc.path(name))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("not cached: '%s'", name)
+	}
+	return e, err
+}
+
+// Entries that have not expired
+func (vc *volumeCache) entries() []*cacheEntry {
+	files, _ := filepath.Glob(filepath.Join(vc.dir, "*.json"))
+
+	out := []*cacheEntry{}
+	for _, f := range files {
+		if e, err := vc.read(f); err == nil {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (vc *volumeCache) remove(name string) {
+	vc.mu.Lock()
+	delete(vc.written, name)
+	vc.mu.Unlock()
+	os.Remove(vc.path(name))
+}
+
+// Read an entry.  Entries that expired or can't be decoded are removed.
+func (vc *volumeCache) read(path string) (*cacheEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := vc.decode(b, fi.ModTime())
+	if err != nil {
+		os.Remove(path)
+	}
+	return e, err
+}
+
+// Decode an entry.  The entry counts as cached when its file was last
+// modified if that is later than when its data was written.
+func (vc *volumeCache) decode(b []byte, modified time.Time) (*cacheEntry, error) {
+	pt, err := decrypt(vc.key, b)
+	if err != nil {
+		return nil, err
+	}
+
+	var e cacheEntry
+	if err = json.Unmarshal(pt, &e); err != nil {
+		return nil, fmt.Errorf("invalid cache entry: %v", err)
+	}
+	if modified.After(e.Cached) {
+		e.Cached = modified.UTC()
+	}
+	if age := time.Since(e.Cached); age > vc.maxAge {
+		return nil, fmt.Errorf("cache expired: '%s' is %v old", e.Volume, age)
+	}
+	return &e, nil
+}
+
+// Backend data a volume is loaded from i.e. its own keys and metadata, those of
+// the envs it inherits from, the keys, templates and schema of its version, the
+// app keys and metadata, the aliases and its revisions.  Other envs and
+// versions read while resolving the volume are left out.
+func volumeData(c *AppConfig, data map[string][]byte) map[string][]byte {
+	envs := map[string]bool{c.Env: true}
+	for _, s := range c.inherited {
+		envs[strings.TrimPrefix(s.name, ScopeEnv+":")] = true
+	}
+
+	out := map[string][]byte{}
+	for k, v := range data {
+		keep := false
+		switch {
+		case strings.HasPrefix(k, c.getOpaque("")):
+			// <env>[/<key>] or version templates, shared keys and schema
+			seg := strings.SplitN(strings.TrimPrefix(k, c.getOpaque("")), "/", 2)[0]
+			keep = envs[seg] || reservedEnvs[seg] || strings.HasPrefix(seg, ".")
+
+		case strings.HasPrefix(k, c.sharedOpaque()), strings.HasPrefix(k, c.appMetaOpaque()),
+			strings.HasPrefix(k, aliasPrefix(c.Name)), strings.HasPrefix(k, c.revisionPrefix()),
+			strings.HasPrefix(k, c.blobPrefix()):
+			keep = true
+		}
+
+		if keep {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// recordingBackend keeps the data read from the backend so it can be cached.
+// The first read error is kept to tell backend failures apart from volumes
+// that do not exist.
+type recordingBackend struct {
+	Backend
+
+	data map[string][]byte
+	err  error
+}
+
+func newRecordingBackend(be Backend) *recordingBackend {
+	return &recordingBackend{Backend: be, data: map[string][]byte{}}
+}
+
+func (rb *recordingBackend) GetMap(prefix string) (map[string][]byte, error) {
+	m, err := rb.Backend.GetMap(prefix)
+	if err != nil {
+		if rb.err == nil {
+			rb.err = err
+		}
+		return nil, err
+	}
+
+	for k, v := range m {
+		rb.data[k] = v
+	}
+	return m, nil
+}
+
+// cachedBackend serves the data of a cache entry.  Changes are refused.
+type cachedBackend struct {
+	data map[string][]byte
+}
+
+func (cb *cachedBackend) GetMap(prefix string) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	for k, v := range cb.data {
+		if strings.HasPrefix(k, prefix) {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+func (cb *cachedBackend) Keys(prefix, separator string) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for k := range cb.data {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], separator); separator != "" && i >= 0 {
+			k = k[:len(prefix)+i+len(separator)]
+		}
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (cb *cachedBackend) SetMap(string, map[string][]byte) error { return errCacheReadOnly }
+func (cb *cachedBackend) DeleteMap(string) error                 { return errCacheReadOnly }
+func (cb *cachedBackend) DeleteKeys(string, []string) error      { return errCacheReadOnly }
+
+func (cb *cachedBackend) CompareAndSet(string, []byte, []byte) (bool, error) {
+	return false, errCacheReadOnly
+}
+
+func (cb *cachedBackend) KeyExists(key string) bool {
+	for k := range cb.data {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// mountTable tracks the volumes mounted on this node along with the ids of the
+// mount requests using them and the volumes whose files were written to their
+// mountpoint.  It is persisted to a file so mounts can be restored and left
+// over files removed after a restart.
+type mountTable struct {
+	mu   sync.RWMutex
+	path string
+	m    map[string][]string
+	// Volumes with files in their mountpoint that are not removed yet
+	rendered map[string]bool
+	// Whether the table was read from its file i.e. what it says about the
+	// mountpoints can be relied upon
+	loaded bool
+}
+
+// Format of the mount table file
+type mountTableFile struct {
+	Mounts   map[string][]string `json:"mounts"`
+	Rendered []string            `json:"rendered,omitempty"`
+}
+
+func newMountTable(path string) *mountTable {
+	return &mountTable{path: path, m: map[string][]string{}, rendered: map[string]bool{}}
+}
+
+// Read the table from its file.  A missing file leaves the table empty and not
+// loaded.
+func (mt *mountTable) load() error {
+	b, err := ioutil.ReadFile(mt.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var f mountTableFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %v", mt.path, err)
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if f.Mounts != nil {
+		mt.m = f.Mounts
+	}
+	for _, name := range f.Rendered {
+		mt.rendered[name] = true
+	}
+	mt.loaded = true
+	return nil
+}
+
+// Record that files of the volume are written to its mountpoint
+func (mt *mountTable) track(name string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.rendered[name] {
+		return nil
+	}
+	mt.rendered[name] = true
+	return mt.save()
+}
+
+// Record that the files of the volume were removed from its mountpoint
+func (mt *mountTable) untrack(name string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	delete(mt.rendered, name)
+	return mt.save()
+}
+
+// Add a mount of the volume
+func (mt *mountTable) add(name, id string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	for _, i := range mt.m[name] {
+		if i == id {
+			return nil
+		}
+	}
+	mt.m[name] = append(mt.m[name], id)
+	mt.rendered[name] = true
+	return mt.save()
+}
+
+// Remove a mount of the volume.  It returns the number of mounts still using
+// the volume.
+func (mt *mountTable) remove(name, id string) (int, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	ids := []string{}
+	for _, i := range mt.m[name] {
+		if i != id {
+			ids = append(ids, i)
+		}
+	}
+
+	if len(ids) == 0 {
+		delete(mt.m, name)
+	} else {
+		mt.m[name] = ids
+	}
+	return len(ids), mt.save()
+}
+
+// Names of the mounted volumes in sorted order
+func (mt *mountTable) names() []string {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	out := make([]string, 0, len(mt.m))
+	for k := range mt.m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Names of the volumes with files in their mountpoint that are no longer
+// mounted in sorted order
+func (mt *mountTable) stale() []string {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	out := []string{}
+	for k := range mt.rendered {
+		if _, ok := mt.m[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (mt *mountTable) save() error {
+	f := mountTableFile{Mounts: mt.m, Rendered: make([]string, 0, len(mt.rendered))}
+	for k := range mt.rendered {
+		f.Rendered = append(f.Rendered, k)
+	}
+	sort.Strings(f.Rendered)
+
+	b, _ := json.Marshal(f)
+	return ioutil.WriteFile(mt.path, b, 0600)
+}
+
+// Bring the mountpoints in line with the mount table after a restart.  Mounted
+// volumes are rendered again as they may have been cleaned up on shutdown or
+// changed in the meantime.  If that fails e.g. as the backend is unreachable
+// the files are left as they are since containers may still be using them.
+// Only the mountpoints the table recorded files for that are no longer mounted
+// are removed.  Without a table nothing is removed as the mountpoints may
+// still be in use.
+func (m *MyVolumeDriver) reconcileMounts() {
+	for _, name := range m.mounts.names() {
+		dpath := m.mountpoint(name)
+
+		c, _, err := m.get(logger, name)
+		if err == nil {
+			err = m.render(logger, c, name, dpath)
+		}
+		if err != nil {
+			logger.Warn("restoring mount failed, keeping existing files", "volume", name, "err", err)
+		}
+	}
+
+	if !m.mounts.loaded {
+		return
+	}
+	for _, name := range m.mounts.stale() {
+		dpath := m.mountpoint(name)
+		logger.Info("removing stale mountpoint", "volume", name, "path", dpath)
+		if err := os.RemoveAll(dpath); err != nil {
+			logger.Warn("removing stale mountpoint failed", "volume", name, "err", err)
+			continue
+		}
+		if err := m.mounts.untrack(name); err != nil {
+			logger.Warn("saving mount table failed", "err", err)
+		}
+	}
+}
+
+// Remove the rendered files of all mounted volumes.  The mount table is kept so
+// they are rendered again on startup.
+func (m *MyVolumeDriver) cleanupMounts() {
+	for _, name := range m.mounts.names() {
+		if err := os.RemoveAll(m.mountpoint(name)); err != nil {
+			logger.Warn("removing mountpoint failed", "volume", name, "err", err)
+		}
+	}
+}
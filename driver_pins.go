@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// revisionPin is the revision a volume is pinned to along with the volume the
+// name resolved to when it was pinned.  Revisions are numbered per volume, so
+// the pin does not apply once an alias points at another volume.
+type revisionPin struct {
+	Rev    int    `json:"rev"`
+	Target string `json:"target"`
+}
+
+// revisionPins tracks volumes pinned to a specific revision on this node.  The
+// pins are persisted to a file so they survive restarts.
+type revisionPins struct {
+	mu   sync.RWMutex
+	path string
+	m    map[string]revisionPin
+}
+
+func newRevisionPins(path string) *revisionPins {
+	return &revisionPins{path: path, m: map[string]revisionPin{}}
+}
+
+func (rp *revisionPins) load() error {
+	b, err := ioutil.ReadFile(rp.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return json.Unmarshal(b, &rp.m)
+}
+
+// Pinned revision of the volume or 0 if it is not pinned.  target is the
+// volume the name currently resolves to.  A pin made while the name resolved
+// to another volume is removed and logged to lg.
+func (rp *revisionPins) get(lg *Logger, name, target string) int {
+	rp.mu.RLock()
+	p, ok := rp.m[name]
+	rp.mu.RUnlock()
+
+	if !ok {
+		return 0
+	}
+	if p.Target != target {
+		lg.Info("revision pin dropped as the volume was retargeted", "volume", name,
+			"revision", p.Rev, "pinned", p.Target, "target", target)
+		if err := rp.set(name, "", 0); err != nil {
+			lg.Warn("removing revision pin failed", "volume", name, "err", err)
+		}
+		return 0
+	}
+	return p.Rev
+}
+
+// Pin the volume resolving to target to the revision.  A revision of 0
+// removes the pin.
+func (rp *revisionPins) set(name, target string, rev int) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rev == 0 {
+		if _, ok := rp.m[name]; !ok {
+			return nil
+		}
+		delete(rp.m, name)
+	} else {
+		rp.m[name] = revisionPin{Rev: rev, Target: target}
+	}
+
+	b, _ := json.Marshal(rp.m)
+	return ioutil.WriteFile(rp.path, b, 0600)
+}
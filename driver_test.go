@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
@@ -44,6 +48,12 @@ func Test_VolumeDriver_Error_Create(t *testing.T) {
 	if resp.Err == "" {
 		t.Fatal("should fail")
 	}
+
+	// only expressible in the explicit form which docker does not allow
+	resp = testDriver.Create(volume.Request{Name: "test@1.2.0-rc1:dev"})
+	if !strings.Contains(resp.Err, "invalid docker volume name") {
+		t.Fatalf("should fail: %s", resp.Err)
+	}
 }
 
 func Test_VolumeDriver_Create(t *testing.T) {
@@ -54,6 +64,7 @@ func Test_VolumeDriver_Create(t *testing.T) {
 			"n1/k1":                "v1",
 			"template:inline.json": `{"key": "${n1/k1}"}`,
 			"template:config.json": "./testdata/config.json",
+			"file:truststore.bin":  "./testdata/truststore.bin",
 		},
 	}
 
@@ -84,6 +95,112 @@ func Test_VolumeDriver_Create(t *testing.T) {
 	}
 }
 
+func Test_VolumeDriver_Create_Schema(t *testing.T) {
+	req := volume.Request{
+		Name: "test-0.9.0-dev",
+		Options: map[string]string{
+			"meta:schema": `{"db/port": {"type": "int", "required": true}}`,
+			"db/port":     "abc",
+		},
+	}
+	if resp := testDriver.Create(req); resp.Err == "" {
+		t.Fatal("should fail")
+	}
+
+	delete(req.Options, "db/port")
+	if resp := testDriver.Create(req); !strings.Contains(resp.Err, "required") {
+		t.Fatalf("should fail: %s", resp.Err)
+	}
+
+	req.Options["db/port"] = "5432"
+	if resp := testDriver.Create(req); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+}
+
+func Test_VolumeDriver_Create_Revision(t *testing.T) {
+	req := volume.Request{Name: testName, Options: map[string]string{"revision": "1"}}
+	if resp := testDriver.Create(req); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+
+	r := testDriver.Get(volume.Request{Name: testName})
+	if r.Err != "" {
+		t.Fatal(r.Err)
+	}
+	if r.Volume.Status["revision"] != 1 {
+		t.Fatalf("not pinned: %+v", r.Volume.Status)
+	}
+
+	req.Options["revision"] = "100"
+	if resp := testDriver.Create(req); resp.Err == "" {
+		t.Fatal("should fail")
+	}
+}
+
+func Test_VolumeDriver_Pin_Retarget(t *testing.T) {
+	ve := testDriver.ve
+	defer ve.RemoveApp("pinned")
+	defer testDriver.be.DeleteMap(revisionsDir + "/pinned/")
+
+	for _, name := range []string{"pinned-1.0.0-prod", "pinned-2.0.0-prod"} {
+		ac, _ := NewAppConfigFromName(name, testDriver.be)
+		ac.Set(map[string][]byte{"db/host": []byte(name)})
+		if err := ac.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ve.SetAlias("pinned", "stable", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := volume.Request{Name: "pinned-stable-prod", Options: map[string]string{"revision": "1"}}
+	if resp := testDriver.Create(req); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if r := testDriver.Get(volume.Request{Name: req.Name}); r.Volume.Status["revision"] != 1 {
+		t.Fatalf("not pinned: %+v", r.Volume.Status)
+	}
+
+	// the revision belongs to 1.0.0 and no longer applies
+	if err := ve.SetAlias("pinned", "stable", "2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if r := testDriver.Get(volume.Request{Name: req.Name}); r.Volume.Status["revision"] != nil {
+		t.Fatalf("pin should be dropped: %+v", r.Volume.Status)
+	}
+	if rev := testDriver.pins.get(logger, req.Name, "pinned-1.0.0-prod"); rev != 0 {
+		t.Fatalf("pin should be removed: %d", rev)
+	}
+}
+
+func Test_VolumeDriver_Create_From(t *testing.T) {
+	name := "test-0.1.2-dev"
+	req := volume.Request{Name: name, Options: map[string]string{"from": testName, "n1/k2": "v2", "shared": "true"}}
+	if resp := testDriver.Create(req); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+
+	c, err := NewAppConfigFromName(name, testDriver.be)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Keys["n1/k1"]) != "v1" || string(c.Keys["n1/k2"]) != "v2" {
+		t.Fatalf("keys not copied: %+v", c.Keys.ToString())
+	}
+	if len(c.Templates) != 3 {
+		t.Fatalf("templates not copied: %d", len(c.Templates))
+	}
+	if _, ok := c.Keys["shared"]; ok {
+		t.Error("shared option should not be set as a key")
+	}
+
+	req = volume.Request{Name: "test-0.1.3-dev", Options: map[string]string{"from": "does-not-exist-0.1.0-dev"}}
+	if resp := testDriver.Create(req); resp.Err == "" {
+		t.Fatal("should fail")
+	}
+}
+
 func Test_VolumeDriver_Get(t *testing.T) {
 
 	req1 := volume.Request{Name: testName}
@@ -169,6 +286,16 @@ func Test_VolumeDriver_Mount(t *testing.T) {
 		t.Fail()
 	}
 
+	b, err = ioutil.ReadFile(testDriver.cfg.MountBaseDir + testAppCfg.getOpaque(testAppCfg.Env+"/truststore.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _ := ioutil.ReadFile("./testdata/truststore.bin")
+	if !bytes.Equal(b, exp) {
+		t.Log("static file not written verbatim")
+		t.Fail()
+	}
+
 }
 
 func Test_VolumeDriver_Unmount(t *testing.T) {
@@ -201,6 +328,245 @@ func Test_VolumeDriver_Remove(t *testing.T) {
 	}
 
 	// Cleanup
-	cbe := testDriver.be.(*ConsulBackend)
-	cbe.DeleteMap("")
+	testDriver.be.DeleteMap("")
+}
+
+func Test_VolumeDriver_Shutdown_Reconcile(t *testing.T) {
+	cfg := NewDriverConfig(testConsulUri, "./testrun", "test-reconcile")
+	d, err := NewVolumeDriver(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.be.DeleteMap("")
+
+	name := "rec-0.1.0-dev"
+	opts := map[string]string{"db/host": "127.0.0.1", "template:config.json": `{"host": "${db/host}"}`}
+	if resp := d.Create(volume.Request{Name: name, Options: opts}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+
+	for _, id := range []string{"a", "b"} {
+		if resp := d.Mount(volume.MountRequest{Name: name, ID: id}); resp.Err != "" {
+			t.Fatal(resp.Err)
+		}
+	}
+	mp := d.mountpoint(name)
+
+	// still in use by b
+	if resp := d.Unmount(volume.UnmountRequest{Name: name, ID: "a"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if _, err = os.Stat(mp + "/config.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// files left by a volume no longer mounted are removed, files the table
+	// knows nothing about are not
+	stale := d.mountpoint("stale-0.1.0-dev")
+	os.MkdirAll(stale, 0777)
+	if err = d.mounts.track("stale-0.1.0-dev"); err != nil {
+		t.Fatal(err)
+	}
+	unknown := cfg.MountBaseDir + "unknown/0.1.0/dev"
+	os.MkdirAll(unknown, 0777)
+	defer os.RemoveAll(cfg.MountBaseDir + "unknown")
+
+	if err = d.Shutdown(time.Second, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(mp); err == nil {
+		t.Error("mountpoint should be removed")
+	}
+	if resp := d.Mount(volume.MountRequest{Name: name, ID: "c"}); resp.Err == "" {
+		t.Error("should fail after shutdown")
+	}
+
+	if d, err = NewVolumeDriver(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(mp + "/config.json"); err != nil || string(b) != `{"host": "127.0.0.1"}` {
+		t.Errorf("not rendered on startup: '%s' %v", b, err)
+	}
+	if _, err = os.Stat(stale); err == nil {
+		t.Error("stale mountpoint should be removed")
+	}
+	if _, err = os.Stat(unknown); err != nil {
+		t.Errorf("unknown mountpoint should be kept: %v", err)
+	}
+
+	// files and mounts are kept if the volume can't be rendered
+	be, cache := d.be, d.cache
+	d.be, d.ve.be, d.cache = failingBackend{be}, failingBackend{be}, nil
+	d.reconcileMounts()
+	d.be, d.ve.be, d.cache = be, be, cache
+	if _, err = os.Stat(mp + "/config.json"); err != nil {
+		t.Errorf("files should be kept: %v", err)
+	}
+	if names := d.mounts.names(); len(names) != 1 || names[0] != name {
+		t.Errorf("mount should be kept: %v", names)
+	}
+
+	if resp := d.Unmount(volume.UnmountRequest{Name: name, ID: "b"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if _, err = os.Stat(mp); err == nil {
+		t.Error("mountpoint should be removed")
+	}
+}
+
+// The first start after an upgrade has no mount table while containers are
+// still using the files
+func Test_VolumeDriver_Reconcile_NoTable(t *testing.T) {
+	cfg := NewDriverConfig(testConsulUri, "./testrun", "test-reconcile-upgrade")
+	os.MkdirAll(cfg.MountBaseDir+"live/0.1.0/dev", 0777)
+	defer os.RemoveAll(cfg.MountBaseDir)
+	if err := ioutil.WriteFile(cfg.MountBaseDir+"live/0.1.0/dev/config.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"", "{not json"} {
+		if table != "" {
+			ioutil.WriteFile(cfg.MountBaseDir+".mounts.json", []byte(table), 0600)
+		}
+		d, err := NewVolumeDriver(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.mounts.loaded {
+			t.Errorf("table %q: should not be loaded", table)
+		}
+		if _, err = os.Stat(cfg.MountBaseDir + "live/0.1.0/dev/config.json"); err != nil {
+			t.Errorf("table %q: files in use should be kept: %v", table, err)
+		}
+	}
+}
+
+type failingBackend struct{ Backend }
+
+func (failingBackend) GetMap(string) (map[string][]byte, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func (failingBackend) KeyExists(string) bool { return false }
+
+func Test_VolumeDriver_Cache(t *testing.T) {
+	cfg := NewDriverConfig(testConsulUri, "./testrun", "test-cache")
+	cfg.EncryptionKey = "0123456789abcdef"
+	d, err := NewVolumeDriver(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.be.DeleteMap("")
+
+	name := "cached-0.1.0-dev"
+	opts := map[string]string{"db/host": "127.0.0.1", "template:config.json": `{"host": "${db/host}"}`}
+	if resp := d.Create(volume.Request{Name: name, Options: opts}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	for _, other := range []string{"cached-0.1.0-prod", "cached-0.2.0-dev"} {
+		if resp := d.Create(volume.Request{Name: other, Options: map[string]string{"db/pass": "secret"}}); resp.Err != "" {
+			t.Fatal(resp.Err)
+		}
+	}
+	if resp := d.Get(volume.Request{Name: name}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	} else if _, ok := resp.Volume.Status["stale"]; ok {
+		t.Error("should not be stale")
+	}
+
+	// only the data of the volume is cached
+	if resp := d.Get(volume.Request{Name: "cached-0.x-dev"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if e, err := d.cache.get("cached-0.x-dev"); err != nil {
+		t.Fatal(err)
+	} else {
+		for k := range e.Data {
+			if strings.Contains(k, "0.1.0/") {
+				t.Errorf("should not be cached: %s", k)
+			}
+		}
+	}
+	d.cache.remove("cached-0.x-dev")
+
+	// unchanged data is not written again but still counts as just cached
+	before, err := ioutil.ReadFile(d.cache.path(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(d.cache.path(name), old, old)
+	if resp := d.Get(volume.Request{Name: name}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if after, _ := ioutil.ReadFile(d.cache.path(name)); !bytes.Equal(before, after) {
+		t.Error("should not be written again")
+	}
+	if e, err := d.cache.get(name); err != nil {
+		t.Fatal(err)
+	} else if time.Since(e.Cached) > time.Minute {
+		t.Errorf("cache time should be refreshed: %v", e.Cached)
+	}
+
+	// backend goes down
+	be := d.be
+	d.be = failingBackend{be}
+	d.ve = &VolEtc{be: d.be, source: "docker"}
+
+	// entries logged while serving the request carry its id
+	var buf bytes.Buffer
+	deflg := logger
+	logger = NewLogger(&buf, LevelInfo, LogFmt)
+	resp := (&instrumentedDriver{d: d}).Get(volume.Request{Name: name})
+	logger = deflg
+	if resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if resp.Volume.Status["stale"] != true {
+		t.Errorf("should be stale: %+v", resp.Volume.Status)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.Contains(line, "req=") {
+			t.Errorf("missing request id: %s", line)
+		}
+	}
+	if !strings.Contains(buf.String(), "serving cached volume") {
+		t.Errorf("cache fallback not logged: %s", buf.String())
+	}
+
+	if resp = d.Mount(volume.MountRequest{Name: name, ID: "a"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if b, err := ioutil.ReadFile(resp.Mountpoint + "/config.json"); err != nil || string(b) != `{"host": "127.0.0.1"}` {
+		t.Errorf("not rendered from cache: '%s' %v", b, err)
+	}
+	d.Unmount(volume.UnmountRequest{Name: name, ID: "a"})
+
+	if resp = d.List(volume.Request{}); resp.Err != "" || len(resp.Volumes) != 1 || resp.Volumes[0].Name != name {
+		t.Errorf("should list cached: %+v", resp)
+	}
+	if resp = d.Get(volume.Request{Name: "uncached-0.1.0-dev"}); resp.Err == "" {
+		t.Error("should fail")
+	}
+
+	// expired
+	d.cache.maxAge = time.Nanosecond
+	if resp = d.Get(volume.Request{Name: name}); resp.Err == "" {
+		t.Error("should fail when expired")
+	}
+	if _, err := os.Stat(d.cache.path(name)); err == nil {
+		t.Error("expired entry should be removed")
+	}
+
+	// no cache without a key
+	if _, err := newVolumeCache(d.cache.dir, "", time.Hour); err == nil {
+		t.Error("should fail without a key")
+	}
+	cfg.EncryptionKey = ""
+	if d, err = NewVolumeDriver(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d.cache != nil {
+		t.Error("cache should be disabled")
+	}
 }
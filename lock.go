@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lock the volume against changes.  Commit, Destroy and Rollback are refused
+// until the volume is unlocked, as are changes to the app and version keys,
+// templates and schema it shares with other envs and to the aliases resolving
+// to it.  The lock is stored in the env metadata i.e. <env>/.meta/locked along
+// with who locked it.
+func (a *AppConfig) Lock() error {
+	if err := a.checkLock(); err != nil {
+		return err
+	}
+
+	author := currentAuthor()
+	if err := a.be.SetMap(a.lockPrefix(), map[string][]byte{"locked": []byte(author)}); err != nil {
+		return err
+	}
+
+	a.Locked, a.LockedBy = true, author
+	a.audit(AuditLock, a.loaded)
+	return nil
+}
+
+func (a *AppConfig) Unlock() error {
+	if locked, _, err := a.lockState(); err != nil {
+		return err
+	} else if !locked {
+		return fmt.Errorf("not locked: '%s'", a.QualifiedName())
+	}
+
+	if err := a.be.DeleteKeys(a.lockPrefix(), []string{"locked"}); err != nil {
+		return err
+	}
+
+	a.Locked, a.LockedBy = false, ""
+	a.audit(AuditUnlock, a.loaded)
+	return nil
+}
+
+func (a *AppConfig) lockPrefix() string {
+	return a.getOpaque(a.Env + "/" + metaDir + "/")
+}
+
+// Lock state as currently stored in the backend rather than when the volume
+// was loaded
+func (a *AppConfig) lockState() (bool, string, error) {
+	m, err := a.be.GetMap(a.lockPrefix() + "locked")
+	if err != nil {
+		return false, "", err
+	}
+
+	by, ok := m[a.lockPrefix()+"locked"]
+	return ok, string(by), nil
+}
+
+func (a *AppConfig) checkLock() error {
+	locked, by, err := a.lockState()
+	if err == nil && locked {
+		err = fmt.Errorf("locked by %s: '%s'", by, a.QualifiedName())
+	}
+	return err
+}
+
+// Error if any env sharing the scope with the volume is locked i.e. any env of
+// the app for the app scope and of the version for the version scope
+func (a *AppConfig) checkScopeLock(scope string) error {
+	prefix := a.getOpaque("")
+	if scope == ScopeApp {
+		prefix = a.Name + "/"
+	}
+
+	m, err := a.be.GetMap(prefix)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range m {
+		// <name>/<version>/<env>/.meta/locked
+		pp := strings.Split(k, "/")
+		if len(pp) == 5 && pp[3] == metaDir && pp[4] == "locked" && !strings.HasPrefix(pp[1], ".") {
+			return fmt.Errorf("%s shared with '%s' locked by %s", scope, volumeNaming.Format(pp[0], pp[1], pp[2]), v)
+		}
+	}
+	return nil
+}
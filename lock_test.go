@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_AppConfig_Lock(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("locked")
+
+	ac, _ := NewAppConfigFromName("locked-0.1.0-prod", ve.be)
+	ac.Set(map[string][]byte{"db/host": []byte("127.0.0.1")})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ac.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.Lock(); err == nil {
+		t.Error("should fail when locked")
+	}
+
+	vol, err := ve.Get("locked-0.1.0-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vol.Locked || vol.LockedBy == "" {
+		t.Errorf("lock not loaded: %+v", vol)
+	}
+
+	vol.Set(map[string][]byte{"db/host": []byte("10.0.0.1")})
+	if err = vol.Commit(); err == nil {
+		t.Error("commit should fail")
+	}
+	if err = vol.Rollback(1, false); err == nil {
+		t.Error("rollback should fail")
+	}
+	if err = vol.Destroy(); err == nil {
+		t.Error("destroy should fail")
+	}
+	if err = ve.RemoveApp("locked"); err == nil {
+		t.Error("remove app should fail")
+	}
+	testDriver.cfg.RemovePolicy = RemoveDestroy
+	if resp := testDriver.Remove(volume.Request{Name: "locked-0.1.0-prod"}); resp.Err == "" {
+		t.Error("driver remove should fail")
+	}
+	testDriver.cfg.RemovePolicy = RemoveRetain
+
+	if err = vol.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.Unlock(); err == nil {
+		t.Error("should fail when not locked")
+	}
+	if err = vol.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_AppConfig_Lock_Shared(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("lockshared")
+
+	for _, name := range []string{"lockshared-0.1.0-prod", "lockshared-0.1.0-dev", "lockshared-0.2.0-dev"} {
+		ac, _ := NewAppConfigFromName(name, ve.be)
+		ac.Set(map[string][]byte{"db/host": []byte("127.0.0.1"), "shared/version/db/port": []byte("5432")})
+		if err := ac.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ve.SetAlias("lockshared", "stable", "0.1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	prod, _ := ve.Get("lockshared-0.1.0-prod")
+	if err := prod.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if md := prod.Metadata(); md["locked"] != true || md["locked_by"] == "" {
+		t.Errorf("lock not in metadata: %+v", md)
+	}
+
+	// env keys of siblings can still be changed
+	dev, _ := ve.Get("lockshared-0.1.0-dev")
+	dev.Set(map[string][]byte{"db/host": []byte("10.0.0.1")})
+	if err := dev.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []map[string][]byte{
+		{"shared/version/db/port": []byte("5433")},
+		{"templates/config.json": []byte(`{"port": {{ .db_port }}}`)},
+		{schemaKey: []byte(`{"db/port": {"type": "int"}}`)},
+		{"shared/app/db/user": []byte("app")},
+	} {
+		dev, _ = ve.Get("lockshared-0.1.0-dev")
+		dev.Set(data)
+		if err := dev.Commit(); err == nil {
+			t.Errorf("should fail: %v", data)
+		}
+	}
+
+	other, _ := ve.Get("lockshared-0.2.0-dev")
+	other.Set(map[string][]byte{"shared/app/db/user": []byte("app")})
+	if err := other.Commit(); err == nil {
+		t.Error("app keys should fail")
+	}
+	other, _ = ve.Get("lockshared-0.2.0-dev")
+	other.Set(map[string][]byte{"shared/version/db/port": []byte("5433")})
+	if err := other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ve.SetAlias("lockshared", "stable", "0.2.0"); err == nil {
+		t.Error("retargeting should fail")
+	}
+	if err := ve.RemoveAlias("lockshared", "stable"); err == nil {
+		t.Error("removing the alias should fail")
+	}
+
+	if err := prod.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ve.SetAlias("lockshared", "stable", "0.2.0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_AppConfig_Commit_Stale(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("stale")
+
+	dev, _ := NewAppConfigFromName("stale-0.1.0-dev", ve.be)
+	dev.Set(map[string][]byte{"shared/version/db/port": []byte("5432")})
+	if err := dev.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	prod, _ := NewAppConfigFromName("stale-0.1.0-prod", ve.be)
+	dev.Set(map[string][]byte{"shared/version/db/port": []byte("5433")})
+	if err := dev.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unchanged shared keys of a copy loaded before are not written
+	prod.Set(map[string][]byte{"db/host": []byte("127.0.0.1")})
+	if err := prod.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ac, _ := ve.Get("stale-0.1.0-prod"); string(ac.VersionKeys["db/port"]) != "5433" {
+		t.Errorf("version key reverted: %s", ac.VersionKeys["db/port"])
+	}
+}
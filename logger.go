@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	LevelDebug logLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.ToLower(s) == n {
+			return logLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level: '%s'", s)
+}
+
+// Log formats
+const (
+	LogFmt  = "logfmt"
+	LogJSON = "json"
+)
+
+// Logger writing to stderr used throughout.  It is configured from the flags
+// on startup.
+var logger = NewLogger(os.Stderr, LevelInfo, LogFmt)
+
+// Logger writes leveled entries made up of a message and key value pairs as
+// logfmt or json e.g.
+//
+//	ts=2017-01-02T15:04:05Z level=warn msg="cache expired" volume=test-0.1.0-dev
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string
+	// Pairs added to every entry
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level logLevel, format string) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, format: format}
+}
+
+// Change the level and format of the logger
+func (l *Logger) Configure(level logLevel, format string) error {
+	if format != LogFmt && format != LogJSON {
+		return fmt.Errorf("invalid log format: '%s'", format)
+	}
+
+	l.mu.Lock()
+	l.level, l.format = level, format
+	l.mu.Unlock()
+	return nil
+}
+
+// Child logger adding the key value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := *l
+	c.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &c
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Log the error and exit
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level logLevel, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	pairs := append([]interface{}{"ts", time.Now().UTC().Format(time.RFC3339), "level", level.String(), "msg", msg}, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, nil)
+	}
+
+	var buf bytes.Buffer
+	if l.format == LogJSON {
+		writeJSONPairs(&buf, pairs)
+	} else {
+		writeLogfmtPairs(&buf, pairs)
+	}
+	buf.WriteByte('\n')
+	l.out.Write(buf.Bytes())
+}
+
+func writeLogfmtPairs(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		v := logValue(pairs[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(buf, "%v=%s", pairs[i], v)
+	}
+}
+
+func writeJSONPairs(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(fmt.Sprint(pairs[i]))
+
+		var v []byte
+		switch pv := pairs[i+1].(type) {
+		case error, fmt.Stringer, nil:
+			v, _ = json.Marshal(logValue(pv))
+		default:
+			var err error
+			if v, err = json.Marshal(pv); err != nil {
+				v, _ = json.Marshal(logValue(pv))
+			}
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+func logValue(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return ""
+	case error:
+		return tv.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+// stdLogWriter passes lines written to the standard logger on to the logger
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(b []byte) (int, error) {
+	logger.Info(strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// Random id to correlate the entries of a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewLogger(&buf, LevelInfo, LogFmt).With("req", "abc")
+
+	lg.Debug("hidden")
+	lg.Warn("cache expired", "volume", "test-0.1.0-dev", "err", fmt.Errorf("too old"))
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("debug should be filtered")
+	}
+	if !strings.Contains(out, ` level=warn msg="cache expired" req=abc volume=test-0.1.0-dev err="too old"`+"\n") {
+		t.Errorf("wrong logfmt: %s", out)
+	}
+
+	buf.Reset()
+	lg = NewLogger(&buf, LevelDebug, LogJSON)
+	lg.Debug("request", "volume", "test-0.1.0-dev", "options", 2)
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "debug" || m["msg"] != "request" || m["volume"] != "test-0.1.0-dev" || m["options"] != float64(2) {
+		t.Errorf("wrong json: %s", buf.String())
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("should fail")
+	}
+	if err := lg.Configure(LevelInfo, "xml"); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -3,14 +3,28 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
 var (
 	driverConfig *DriverConfig
+	// Client contexts
+	contextConfig *ContextConfig
+)
+
+// Group owning the plugin unix socket and the directory docker discovers it in
+const (
+	pluginSockGroup = "root"
+	pluginSockDir   = "/run/docker/plugins"
 )
 
 func init() {
@@ -18,10 +32,78 @@ func init() {
 	flag.Parse()
 	setDefaultVersionInfo()
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	st, err := applySettings(flag.CommandLine, os.Getenv)
+	if err != nil {
+		logger.Fatal("invalid configuration", "err", err)
+	}
+
+	// Client settings not given explicitly come from the context in use.  The
+	// context command is how a broken config is fixed so it never applies one.
+	if !*serverMode {
+		path := defaultContextConfigPath()
+		if contextConfig, err = LoadContextConfig(path); err != nil {
+			logger.Warn("ignoring invalid client config", "err", err)
+			contextConfig = NewContextConfig(path)
+		}
+		if args := flag.Args(); len(args) == 0 || args[0] != "context" {
+			name := *ctxName
+			if name == "" {
+				name = contextConfig.Current
+			}
+			ctx, err := contextConfig.Context(name)
+			if err == nil && ctx != nil {
+				err = applyContext(flag.CommandLine, st, ctx, name)
+			}
+			if err != nil {
+				logger.Warn("ignoring client context", "err", err)
+			}
+		}
+	}
+	if *outputFmt != OutputTable && *outputFmt != OutputJSON {
+		logger.Fatal("invalid configuration", "err", st.errorf("o", fmt.Errorf("invalid output: '%s'", *outputFmt)))
+	}
+
+	level, err := parseLogLevel(*logLvl)
+	if err != nil {
+		logger.Fatal("invalid configuration", "err", st.errorf("log-level", err))
+	}
+	if err = logger.Configure(level, *logFormat); err != nil {
+		logger.Fatal("invalid configuration", "err", st.errorf("log-format", err))
+	}
+	// libraries logging through the standard logger
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+
+	if volumeNaming, err = NewNamingScheme(*nameFormat, *nameRegexp); err != nil {
+		field := "naming"
+		if *nameRegexp != "" && strings.Contains(err.Error(), "regexp") {
+			field = "naming-regexp"
+		}
+		logger.Fatal("invalid configuration", "err", st.errorf(field, err))
+	}
 
+	if _, _, err = parseBackendUri(*backendUri); err != nil {
+		logger.Fatal("invalid configuration", "err", st.errorf("H", err))
+	}
 	driverConfig = NewDriverConfig(*backendUri, *baseDir, *dataPrefix)
 	driverConfig.EncryptionKey = *encDec
+	if *encDec == "" && *keyFile != "" {
+		b, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			logger.Fatal("invalid configuration", "err", st.errorf("key-file", err))
+		}
+		driverConfig.EncryptionKey = strings.TrimSpace(string(b))
+	}
+	if *chunkSize < minChunkSize || *chunkSize > maxChunkSize {
+		logger.Fatal("invalid configuration", "err", st.errorf("chunk-size",
+			fmt.Errorf("must be between %d and %d: %d", minChunkSize, maxChunkSize, *chunkSize)))
+	}
+	driverConfig.ChunkSize = *chunkSize
+	driverConfig.TrashTTL = *trashTTL
+	driverConfig.CacheMaxAge = *cacheAge
+	if driverConfig.RemovePolicy, err = parseRemovePolicy(*rmPolicy); err != nil {
+		logger.Fatal("invalid configuration", "err", st.errorf("remove-policy", err))
+	}
 }
 
 func runServer() error {
@@ -30,20 +112,63 @@ func runServer() error {
 		return err
 	}
 	// New docker volume driver handler
-	handler := volume.NewHandler(driver)
+	handler := volume.NewHandler(&instrumentedDriver{d: driver})
+
+	if driverConfig.RemovePolicy == RemoveTrash {
+		go driver.purgeTrash(trashPurgeInterval)
+	}
 
-	log.Println("Starting sevice on:", *listenAddr)
-	if err = handler.ServeTCP(driverName, *listenAddr); err != nil {
+	if *statusAddr != "" {
+		logger.Info("serving metrics", "addr", *statusAddr)
+		go func() {
+			if err := http.ListenAndServe(*statusAddr, newStatusHandler(driver)); err != nil {
+				logger.Error("serving metrics failed", "err", err)
+			}
+		}()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		if *sockName != "" {
+			logger.Info("starting service", "socket", *sockName)
+			err = handler.ServeUnix(pluginSockGroup, *sockName)
+		} else {
+			logger.Info("starting service", "addr", *listenAddr)
+			err = handler.ServeTCP(driverName, *listenAddr)
+		}
+		if err != nil {
+			errc <- err
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err = <-errc:
 		return err
+	case sig := <-sigs:
+		logger.Info("shutting down", "signal", sig)
 	}
 
-	select {}
+	if *sockName != "" {
+		os.Remove(filepath.Join(pluginSockDir, *sockName+".sock"))
+	}
+	return driver.Shutdown(*drainTime, *cleanup)
 }
 
 func runClient() {
-	cl, err := newCli(driverConfig)
-	if err == nil {
-		err = cl.Run(flag.Args())
+	var (
+		cl  *cli
+		err error
+	)
+
+	// contexts are managed without a backend
+	if args := flag.Args(); len(args) > 0 && args[0] == "context" {
+		err = runContextCmd(contextConfig, args[1:])
+	} else if cl, err = newCli(driverConfig); err == nil {
+		err = cl.Run(args)
 	}
 
 	if err != nil {
@@ -57,7 +182,7 @@ func main() {
 	//var err error
 	if *serverMode {
 		if err := runServer(); err != nil {
-			log.Fatal(err)
+			logger.Fatal("service failed", "err", err)
 		}
 		return
 	}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// Upper bounds of the latency histogram buckets in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	driverRequests  = newCounterVec("voletc_driver_requests_total", "Docker plugin requests by endpoint.", "endpoint")
+	driverErrors    = newCounterVec("voletc_driver_request_errors_total", "Docker plugin requests that returned an error by endpoint.", "endpoint")
+	driverDurations = newHistogramVec("voletc_driver_request_duration_seconds", "Docker plugin request latencies by endpoint.", "endpoint")
+
+	backendOps       = newCounterVec("voletc_backend_operations_total", "Backend operations by operation.", "op")
+	backendErrors    = newCounterVec("voletc_backend_errors_total", "Backend operations that failed by operation.", "op")
+	backendDurations = newHistogramVec("voletc_backend_operation_duration_seconds", "Backend operation latencies by operation.", "op")
+
+	renderFailures = newCounterVec("voletc_render_failures_total", "Volumes that failed to render.", "")
+	cacheServed    = newCounterVec("voletc_cache_served_total", "Volumes served from the local cache while the backend was unavailable.", "")
+)
+
+// counterVec is a counter partitioned by the value of a single label.  Counters
+// without a label use the empty label value.
+type counterVec struct {
+	name, help, label string
+
+	mu sync.Mutex
+	m  map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, m: map[string]float64{}}
+}
+
+func (cv *counterVec) inc(lv string) {
+	cv.mu.Lock()
+	cv.m[lv]++
+	cv.mu.Unlock()
+}
+
+func (cv *counterVec) get(lv string) float64 {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	return cv.m[lv]
+}
+
+func (cv *counterVec) write(w io.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cv.name, cv.help, cv.name)
+	if cv.label == "" {
+		fmt.Fprintf(w, "%s %s\n", cv.name, formatFloat(cv.m[""]))
+		return
+	}
+	for _, lv := range sortedKeys(cv.m) {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", cv.name, cv.label, lv, formatFloat(cv.m[lv]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram partitioned by the value of a single label
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu sync.Mutex
+	m  map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: defaultBuckets, m: map[string]*histogram{}}
+}
+
+func (hv *histogramVec) observe(lv string, v float64) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	h, ok := hv.m[lv]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hv.buckets))}
+		hv.m[lv] = h
+	}
+	for i, b := range hv.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+
+	lvs := make([]string, 0, len(hv.m))
+	for lv := range hv.m {
+		lvs = append(lvs, lv)
+	}
+	sort.Strings(lvs)
+
+	for _, lv := range lvs {
+		h := hv.m[lv]
+		for i, b := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%s\"} %d\n", hv.name, hv.label, lv, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", hv.name, hv.label, lv, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", hv.name, hv.label, lv, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", hv.name, hv.label, lv, h.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// instrumentedBackend counts and times the operations of the backend it wraps
+type instrumentedBackend struct {
+	be Backend
+}
+
+func (ib *instrumentedBackend) observe(op string, start time.Time, err error) {
+	backendOps.inc(op)
+	backendDurations.observe(op, time.Since(start).Seconds())
+	if err != nil {
+		backendErrors.inc(op)
+	}
+}
+
+func (ib *instrumentedBackend) GetMap(prefix string) (map[string][]byte, error) {
+	// health checks e.g. on every scrape are not counted
+	if prefix == healthPrefix {
+		return ib.be.GetMap(prefix)
+	}
+
+	start := time.Now()
+	m, err := ib.be.GetMap(prefix)
+	ib.observe("get_map", start, err)
+	return m, err
+}
+
+func (ib *instrumentedBackend) Keys(prefix, separator string) ([]string, error) {
+	start := time.Now()
+	keys, err := ib.be.Keys(prefix, separator)
+	ib.observe("keys", start, err)
+	return keys, err
+}
+
+func (ib *instrumentedBackend) SetMap(prefix string, kmap map[string][]byte) error {
+	start := time.Now()
+	err := ib.be.SetMap(prefix, kmap)
+	ib.observe("set_map", start, err)
+	return err
+}
+
+func (ib *instrumentedBackend) DeleteMap(prefix string) error {
+	start := time.Now()
+	err := ib.be.DeleteMap(prefix)
+	ib.observe("delete_map", start, err)
+	return err
+}
+
+func (ib *instrumentedBackend) DeleteKeys(prefix string, keys []string) error {
+	start := time.Now()
+	err := ib.be.DeleteKeys(prefix, keys)
+	ib.observe("delete_keys", start, err)
+	return err
+}
+
+func (ib *instrumentedBackend) CompareAndSet(key string, old, value []byte) (bool, error) {
+	start := time.Now()
+	ok, err := ib.be.CompareAndSet(key, old, value)
+	ib.observe("compare_and_set", start, err)
+	return ok, err
+}
+
+// KeyExists of the backend swallows errors so they are only counted if the
+// backend reports them separately
+func (ib *instrumentedBackend) KeyExists(key string) bool {
+	start := time.Now()
+
+	if kb, ok := ib.be.(interface {
+		keyExists(string) (bool, error)
+	}); ok {
+		ok, err := kb.keyExists(key)
+		ib.observe("key_exists", start, err)
+		if err != nil {
+			logger.Warn("key lookup failed", "key", key, "err", err)
+		}
+		return ok
+	}
+
+	ok := ib.be.KeyExists(key)
+	ib.observe("key_exists", start, nil)
+	return ok
+}
+
+// instrumentedDriver logs, counts and times the requests docker makes to the
+// driver.  Each request is logged with an id to correlate its entries.
+type instrumentedDriver struct {
+	d *MyVolumeDriver
+}
+
+// Start a request returning its logger and the function to finish it with the
+// response
+func (id *instrumentedDriver) begin(endpoint, name string, kv ...interface{}) (*Logger, func(volume.Response) volume.Response) {
+	lg := logger.With("req", newRequestID(), "endpoint", endpoint)
+	if name != "" {
+		lg = lg.With("volume", name)
+	}
+	lg.Debug("request", kv...)
+	start := time.Now()
+
+	return lg, func(resp volume.Response) volume.Response {
+		d := time.Since(start)
+		driverRequests.inc(endpoint)
+		driverDurations.observe(endpoint, d.Seconds())
+
+		if resp.Err != "" {
+			driverErrors.inc(endpoint)
+			lg.Error("request failed", "duration", d, "err", resp.Err)
+		} else {
+			lg.Info("request", "duration", d)
+		}
+		return resp
+	}
+}
+
+func (id *instrumentedDriver) Create(req volume.Request) volume.Response {
+	lg, end := id.begin("create", req.Name, "options", len(req.Options))
+	return end(id.d.create(lg, req))
+}
+
+func (id *instrumentedDriver) List(req volume.Request) volume.Response {
+	lg, end := id.begin("list", "")
+	return end(id.d.list(lg, req))
+}
+
+func (id *instrumentedDriver) Get(req volume.Request) volume.Response {
+	lg, end := id.begin("get", req.Name)
+	return end(id.d.inspect(lg, req))
+}
+
+func (id *instrumentedDriver) Remove(req volume.Request) volume.Response {
+	lg, end := id.begin("remove", req.Name)
+	return end(id.d.remove(lg, req))
+}
+
+func (id *instrumentedDriver) Path(req volume.Request) volume.Response {
+	lg, end := id.begin("path", req.Name)
+	return end(id.d.path(lg, req))
+}
+
+func (id *instrumentedDriver) Mount(req volume.MountRequest) volume.Response {
+	lg, end := id.begin("mount", req.Name, "mount_id", req.ID)
+	return end(id.d.mount(lg, req))
+}
+
+func (id *instrumentedDriver) Unmount(req volume.UnmountRequest) volume.Response {
+	lg, end := id.begin("unmount", req.Name, "mount_id", req.ID)
+	return end(id.d.unmount(lg, req))
+}
+
+func (id *instrumentedDriver) Capabilities(req volume.Request) volume.Response {
+	_, end := id.begin("capabilities", "")
+	return end(id.d.Capabilities(req))
+}
+
+// Handler serving /metrics, /healthz and /readyz for the driver
+func newStatusHandler(d *MyVolumeDriver) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		for _, cv := range []*counterVec{driverRequests, driverErrors} {
+			cv.write(w)
+		}
+		driverDurations.write(w)
+		for _, cv := range []*counterVec{backendOps, backendErrors} {
+			cv.write(w)
+		}
+		backendDurations.write(w)
+		renderFailures.write(w)
+		cacheServed.write(w)
+
+		up := 0.0
+		if d.checkBackend() == nil {
+			up = 1
+		}
+		writeGauge(w, "voletc_backend_up", "Whether the backend is reachable.", up)
+		writeGauge(w, "voletc_active_mounts", "Volumes mounted on this node.", float64(len(d.mounts.names())))
+	})
+
+	// Alive as long as mounts can be served either from the backend or the
+	// local cache
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.checkBackend(); err != nil && d.cache == nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	// Ready when the backend is reachable and the driver is not shutting down
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		err := d.checkBackend()
+		if err == nil && d.isStopping() {
+			err = errShuttingDown
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	return mux
+}
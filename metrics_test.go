@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_histogramVec(t *testing.T) {
+	hv := newHistogramVec("test_seconds", "Test.", "op")
+	hv.observe("get", 0.003)
+	hv.observe("get", 0.2)
+
+	var buf bytes.Buffer
+	hv.write(&buf)
+	out := buf.String()
+
+	for _, exp := range []string{
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{op="get",le="0.005"} 1` + "\n",
+		`test_seconds_bucket{op="get",le="0.25"} 2` + "\n",
+		`test_seconds_bucket{op="get",le="+Inf"} 2` + "\n",
+		`test_seconds_sum{op="get"} 0.203` + "\n",
+		`test_seconds_count{op="get"} 2` + "\n",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("missing %q in:\n%s", exp, out)
+		}
+	}
+}
+
+func Test_StatusHandler(t *testing.T) {
+	id := &instrumentedDriver{d: testDriver}
+	id.Get(volume.Request{Name: "does-not-exist-0.1.0-dev"})
+
+	srv := httptest.NewServer(newStatusHandler(testDriver))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, exp := range []string{
+		`voletc_driver_requests_total{endpoint="get"}`,
+		`voletc_driver_request_errors_total{endpoint="get"}`,
+		`voletc_backend_operations_total{op="get_map"}`,
+		"voletc_backend_up 1\n",
+		"voletc_active_mounts ",
+	} {
+		if !strings.Contains(string(b), exp) {
+			t.Errorf("missing %q", exp)
+		}
+	}
+
+	for _, p := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: %d", p, resp.StatusCode)
+		}
+	}
+}
+
+func Test_instrumentedBackend_Errors(t *testing.T) {
+	cb, err := NewConsulBackend("127.0.0.1:1", "test-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ib := &instrumentedBackend{be: cb}
+
+	before := backendErrors.get("key_exists")
+	if ib.KeyExists("a") {
+		t.Error("should not exist")
+	}
+	if backendErrors.get("key_exists") != before+1 {
+		t.Error("lookup error should be counted")
+	}
+
+	// health checks are not counted
+	before = backendOps.get("get_map")
+	if err = testDriver.checkBackend(); err != nil {
+		t.Fatal(err)
+	}
+	if backendOps.get("get_map") != before {
+		t.Error("health check should not be counted")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Default volume naming i.e. <name>-<version>-<env>.  The name may contain the
+// separator, the version and env may not.
+const defaultNameFormat = "{name}-{version}-{env}"
+
+var nameFields = []string{"name", "version", "env"}
+
+// Naming scheme used to parse and format volume names
+var volumeNaming, _ = NewNamingScheme(defaultNameFormat, "")
+
+// NamingScheme parses volume names into their name, version and env and
+// formats them back.  Names can always be given explicitly as
+// <name>@<version>:<env> regardless of the scheme.
+type NamingScheme struct {
+	format string
+	re     *regexp.Regexp
+}
+
+// Create a naming scheme from a format containing {name}, {version} and {env}
+// separated by literals e.g. {name}_{version}_{env}.  Names are parsed with
+// expr if provided which must contain the named groups name, version and env.
+// Otherwise the expression is derived from the format.
+func NewNamingScheme(format, expr string) (*NamingScheme, error) {
+	ns := &NamingScheme{format: format}
+
+	derived := "^"
+	rest := format
+	for i := 0; rest != ""; i++ {
+		s := strings.Index(rest, "{")
+		if s < 0 {
+			derived += regexp.QuoteMeta(rest)
+			break
+		}
+		if s == 0 && i > 0 {
+			return nil, fmt.Errorf("invalid naming format: separator missing in '%s'", format)
+		}
+		derived += regexp.QuoteMeta(rest[:s])
+
+		e := strings.Index(rest, "}")
+		if e < s {
+			return nil, fmt.Errorf("invalid naming format: '%s'", format)
+		}
+
+		field := rest[s+1 : e]
+		switch {
+		case field == "name":
+			// the name may contain the separators
+			derived += "(?P<name>.+)"
+		case field == "version" || field == "env":
+			derived += "(?P<" + field + ">.+?)"
+		default:
+			return nil, fmt.Errorf("invalid naming format: unknown field '{%s}'", field)
+		}
+		rest = rest[e+1:]
+	}
+	derived += "$"
+
+	for _, f := range nameFields {
+		if strings.Count(format, "{"+f+"}") != 1 {
+			return nil, fmt.Errorf("invalid naming format: '{%s}' required once in '%s'", f, format)
+		}
+	}
+
+	if expr == "" {
+		expr = derived
+	}
+
+	var err error
+	if ns.re, err = regexp.Compile(expr); err != nil {
+		return nil, fmt.Errorf("invalid naming regexp: %v", err)
+	}
+
+	groups := map[string]bool{}
+	for _, g := range ns.re.SubexpNames() {
+		groups[g] = true
+	}
+	for _, f := range nameFields {
+		if !groups[f] {
+			return nil, fmt.Errorf("invalid naming regexp: group '%s' missing", f)
+		}
+	}
+
+	return ns, nil
+}
+
+// Parse a volume name given in the format of the scheme or explicitly as
+// <name>@<version>:<env>
+func (ns *NamingScheme) Parse(n string) (name, version, env string, err error) {
+	if i, j := strings.Index(n, "@"), strings.LastIndex(n, ":"); i > 0 && j > i {
+		name, version, env = n[:i], n[i+1:j], n[j+1:]
+	} else {
+		m := ns.re.FindStringSubmatch(n)
+		if m == nil {
+			err = fmt.Errorf("invalid name: '%s' expected %s or <name>@<version>:<env>", n,
+				strings.NewReplacer("{", "<", "}", ">").Replace(ns.format))
+			return
+		}
+
+		for i, g := range ns.re.SubexpNames() {
+			switch g {
+			case "name":
+				name = m[i]
+			case "version":
+				version = m[i]
+			case "env":
+				env = m[i]
+			}
+		}
+	}
+
+	err = validateNameParts(n, name, version, env)
+	return
+}
+
+// Format a volume name.  The explicit form is used if the formatted name would
+// not parse back to the same parts e.g. when the version contains the
+// separator.
+func (ns *NamingScheme) Format(name, version, env string) string {
+	out := strings.NewReplacer("{name}", name, "{version}", version, "{env}", env).Replace(ns.format)
+
+	if n, v, e, err := ns.Parse(out); err != nil || n != name || v != version || e != env {
+		return name + "@" + version + ":" + env
+	}
+	return out
+}
+
+// Characters docker allows in volume names
+var dockerNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// Format the name of a docker volume.  It is an error if the name can only be
+// given in the explicit form or contains characters docker does not allow.
+func (ns *NamingScheme) DockerName(name, version, env string) (string, error) {
+	n := ns.Format(name, version, env)
+	if !dockerNameRe.MatchString(n) {
+		return "", fmt.Errorf("invalid docker volume name: '%s' cannot be named with %s", n, ns.format)
+	}
+	return n, nil
+}
+
+// Parts must be usable as part of the backend key layout
+func validateNameParts(n, name, version, env string) error {
+	if name == "" || version == "" || env == "" {
+		return fmt.Errorf("invalid name: '%s'", n)
+	}
+
+	for _, p := range []string{name, version, env} {
+		if strings.ContainsAny(p, "/@:") {
+			return fmt.Errorf("invalid name: '%s' contains '/', '@' or ':'", n)
+		}
+		if strings.HasPrefix(p, ".") {
+			return fmt.Errorf("reserved name: '%s'", n)
+		}
+	}
+
+	if reservedVersions[version] || reservedEnvs[env] {
+		return fmt.Errorf("reserved name: '%s'", n)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_NamingScheme(t *testing.T) {
+	custom, err := NewNamingScheme("{env}.{name}_{version}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := NewNamingScheme("{name}-{version}-{env}", `^(?P<name>[a-z-]+)-(?P<version>\d+\.\d+\.\d+(-rc\d+)?)-(?P<env>.+)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ns                 *NamingScheme
+		in                 string
+		name, version, env string
+	}{
+		{volumeNaming, "test-0.1.0-dev", "test", "0.1.0", "dev"},
+		{volumeNaming, "my-app-0.1.0-dev", "my-app", "0.1.0", "dev"},
+		{volumeNaming, "my-app@1.2.0-rc1:us-east", "my-app", "1.2.0-rc1", "us-east"},
+		{custom, "us-east.my_app_1.2.0-rc1", "my_app", "1.2.0-rc1", "us-east"},
+		{re, "my-app-1.2.0-rc1-us-east", "my-app", "1.2.0-rc1", "us-east"},
+	} {
+		n, v, e, err := c.ns.Parse(c.in)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if n != c.name || v != c.version || e != c.env {
+			t.Errorf("%s: got %s %s %s", c.in, n, v, e)
+		}
+	}
+
+	for _, in := range []string{"test-0.1.0", "test@0.1.0:", "a/b-0.1.0-dev", "test-shared-dev", "test-0.1.0-.meta"} {
+		if _, _, _, err = volumeNaming.Parse(in); err == nil {
+			t.Errorf("%s: should fail", in)
+		}
+	}
+
+	if n := volumeNaming.Format("test", "0.1.0", "dev"); n != "test-0.1.0-dev" {
+		t.Errorf("wrong name: %s", n)
+	}
+	// does not parse back with the scheme
+	if n := volumeNaming.Format("test", "1.2.0-rc1", "dev"); n != "test@1.2.0-rc1:dev" {
+		t.Errorf("wrong name: %s", n)
+	}
+	if n := re.Format("my-app", "1.2.0-rc1", "us-east"); n != "my-app-1.2.0-rc1-us-east" {
+		t.Errorf("wrong name: %s", n)
+	}
+
+	if n, err := volumeNaming.DockerName("test", "0.1.0", "dev"); err != nil || n != "test-0.1.0-dev" {
+		t.Errorf("wrong name: %s %v", n, err)
+	}
+	if n, err := volumeNaming.DockerName("test", "1.2.0-rc1", "dev"); err == nil {
+		t.Errorf("should fail: %s", n)
+	}
+
+	for _, f := range []string{"{name}-{version}", "{name}{version}-{env}", "{name}-{version}-{env}-{foo}", "{name}-{name}-{env}"} {
+		if _, err = NewNamingScheme(f, ""); err == nil {
+			t.Errorf("%s: should fail", f)
+		}
+	}
+	if _, err = NewNamingScheme(defaultNameFormat, `(?P<name>.+)-(?P<version>.+)`); err == nil {
+		t.Error("should fail without env group")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Top level directory revisions are stored under i.e.
+// .revisions/<name>/<version>/<env>/<rev> with template bodies stored by sha1
+// under .revisions/<name>/<version>/.blobs/<sha1>
+const revisionsDir = ".revisions"
+
+// Revision is an immutable record of the state of a volume at the time of a
+// commit.  Template bodies are referenced by sha1.
+type Revision struct {
+	Rev       int       `json:"rev"`
+	Timestamp time.Time `json:"timestamp"`
+	Author    string    `json:"author"`
+	Source    string    `json:"source,omitempty"`
+	Message   string    `json:"message,omitempty"`
+
+	Parent      string     `json:"parent,omitempty"`
+	Keys        ConfigKeys `json:"keys"`
+	VersionKeys ConfigKeys `json:"version_keys,omitempty"`
+	AppKeys     ConfigKeys `json:"app_keys,omitempty"`
+	// Template backend key to sha1 of the body
+	Templates map[string]string `json:"templates"`
+}
+
+// User and host performing a change
+func currentAuthor() string {
+	host, _ := os.Hostname()
+	return currentUser() + "@" + host
+}
+
+func (a *AppConfig) revisionPrefix() string {
+	return revisionsDir + "/" + a.getOpaque(a.Env+"/")
+}
+
+func (a *AppConfig) blobPrefix() string {
+	return revisionsDir + "/" + a.getOpaque(".blobs/")
+}
+
+// Times a commit retries to claim the next revision number when other commits
+// claim it first
+const maxRevisionRetries = 10
+
+// Store the template bodies and a new revision of the in mem datastructure.
+// This is called after the data has been committed.
+func (a *AppConfig) recordRevision(msg string) (*Revision, error) {
+	n, err := a.nextRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	rev := &Revision{
+		Rev:         n,
+		Timestamp:   time.Now().UTC(),
+		Author:      currentAuthor(),
+		Source:      a.source,
+		Message:     msg,
+		Parent:      a.Parent,
+		Keys:        a.Keys,
+		VersionKeys: a.VersionKeys,
+		AppKeys:     a.AppKeys,
+		Templates:   map[string]string{},
+	}
+
+	// Blobs are content addressed so they are written one at a time before the
+	// revision referencing them
+	for _, tmpls := range [][]*Template{a.Templates, a.EnvTemplates} {
+		for _, t := range tmpls {
+			rev.Templates[t.Key()] = t.Sha1
+			if err = a.be.SetMap(a.blobPrefix(), map[string][]byte{t.Sha1: t.Body}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b, err := json.Marshal(rev)
+	if err == nil {
+		err = a.be.SetMap(a.revisionPrefix(), map[string][]byte{fmt.Sprintf("%08d", rev.Rev): b})
+	}
+
+	return rev, err
+}
+
+// Claim the next revision number by bumping the head with a compare and set so
+// concurrent commits never record the same revision
+func (a *AppConfig) nextRevision() (int, error) {
+	key := a.revisionPrefix() + "head"
+
+	for i := 0; i < maxRevisionRetries; i++ {
+		head, err := a.headRevision()
+		if err != nil {
+			return 0, err
+		}
+
+		var old []byte
+		if head > 0 {
+			old = []byte(strconv.Itoa(head))
+		}
+
+		ok, err := a.be.CompareAndSet(key, old, []byte(strconv.Itoa(head+1)))
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return head + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("recording revision failed: head changed %d times", maxRevisionRetries)
+}
+
+// Latest revision number or 0 if there are none
+func (a *AppConfig) headRevision() (int, error) {
+	m, err := a.be.GetMap(a.revisionPrefix() + "head")
+	if err != nil {
+		return 0, err
+	}
+
+	v, ok := m[a.revisionPrefix()+"head"]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+// Revisions of the volume ordered oldest first
+func (a *AppConfig) Revisions() ([]*Revision, error) {
+	m, err := a.be.GetMap(a.revisionPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	out := []*Revision{}
+	for k, v := range m {
+		if strings.HasSuffix(k, "/head") {
+			continue
+		}
+
+		var rev Revision
+		if err = json.Unmarshal(v, &rev); err != nil {
+			return nil, fmt.Errorf("invalid revision '%s': %v", k, err)
+		}
+		out = append(out, &rev)
+	}
+
+	sort.Sort(revisionsByNumber(out))
+	return out, nil
+}
+
+// Get a single revision of the volume
+func (a *AppConfig) Revision(n int) (*Revision, error) {
+	key := a.revisionPrefix() + fmt.Sprintf("%08d", n)
+	m, err := a.be.GetMap(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("revision not found: %d", n)
+	}
+
+	var rev Revision
+	err = json.Unmarshal(v, &rev)
+	return &rev, err
+}
+
+// Replace the in mem datastructure with the given revision.  The app and
+// version keys and the version templates shared with other envs are only
+// replaced if shared is set.
+func (a *AppConfig) LoadRevision(n int, shared bool) error {
+	rev, err := a.Revision(n)
+	if err != nil {
+		return err
+	}
+
+	a.Keys, a.EnvTemplates = ConfigKeys{}, []*Template{}
+	a.Parent, a.setParent = rev.Parent, true
+	a.inherited = nil
+
+	for k, v := range rev.Keys {
+		a.Keys[k] = v
+	}
+
+	if shared {
+		a.VersionKeys, a.AppKeys, a.Templates = ConfigKeys{}, ConfigKeys{}, []*Template{}
+		for k, v := range rev.VersionKeys {
+			a.VersionKeys[k] = v
+		}
+		for k, v := range rev.AppKeys {
+			a.AppKeys[k] = v
+		}
+	}
+
+	for key, sum := range rev.Templates {
+		if !shared && !strings.HasPrefix(key, a.Env+"/") {
+			continue
+		}
+
+		blobs, err := a.be.GetMap(a.blobPrefix() + sum)
+		if err != nil {
+			return err
+		}
+
+		body, ok := blobs[a.blobPrefix()+sum]
+		if !ok {
+			return fmt.Errorf("template missing for revision %d: %s", n, key)
+		}
+
+		env := ""
+		if strings.HasPrefix(key, a.Env+"/") {
+			env = a.Env
+			key = strings.TrimPrefix(key, a.Env+"/")
+		}
+
+		if t := NewTemplateFromKey(key); t != nil {
+			t.Env = env
+			t.SetBody(body)
+			if err := a.AddTemplate(t); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Resolve inherited keys from the current state of the parents
+	if a.Parent != "" {
+		gm, err := a.be.GetMap(a.getOpaque(""))
+		if err != nil {
+			return err
+		}
+		a.inherited, err = a.resolveParents(gm)
+		return err
+	}
+
+	return nil
+}
+
+// Restore the volume to the given revision.  Only the env keys, template
+// overrides and parent are restored unless shared is set, in which case the
+// app and version keys and the version templates are restored as well.  Keys
+// not part of the revision are removed on commit, so the restored state is
+// written in one go rather than wiping the env first.  The rollback is
+// recorded as a new revision.
+func (a *AppConfig) Rollback(n int, shared bool) error {
+	if err := a.checkLock(); err != nil {
+		return err
+	}
+
+	prev := a.snapshot()
+	if err := a.LoadRevision(n, shared); err != nil {
+		return err
+	}
+
+	cur := a.snapshot()
+	for k := range prev {
+		if _, ok := cur[k]; ok {
+			continue
+		}
+		key, err := optionStorageKey(k)
+		if err != nil {
+			return err
+		}
+		if a.removed == nil {
+			a.removed = map[string]bool{}
+		}
+		a.removed[a.backendKey(key)] = true
+	}
+
+	a.revisionMsg = fmt.Sprintf("rollback to %d", n)
+	return a.Commit()
+}
+
+type revisionsByNumber []*Revision
+
+func (r revisionsByNumber) Len() int           { return len(r) }
+func (r revisionsByNumber) Less(i, j int) bool { return r[i].Rev < r[j].Rev }
+func (r revisionsByNumber) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
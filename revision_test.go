@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_AppConfig_Rollback(t *testing.T) {
+	be := testDriver.be
+	defer be.DeleteMap("revs/")
+	defer be.DeleteMap(revisionsDir + "/revs/")
+
+	ac, _ := NewAppConfigFromName("revs-0.1.0-dev", be)
+	ac.Set(map[string][]byte{"k1": []byte("v1"), "templates/t.json": []byte(`{"k1": "${k1}"}`)})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ac.Set(map[string][]byte{"k1": []byte("v2"), "k2": []byte("v2"), "templates/t.json": []byte(`{}`)})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := ac.Revisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Rev != 1 || revs[1].Rev != 2 {
+		t.Fatalf("wrong revisions: %+v", revs)
+	}
+
+	if err = ac.Rollback(1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err = NewAppConfigFromName("revs-0.1.0-dev", be)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ac.Keys["k1"]) != "v1" {
+		t.Errorf("wrong value: %s", ac.Keys["k1"])
+	}
+	if _, ok := ac.Keys["k2"]; ok {
+		t.Error("key should be removed")
+	}
+	// the version template is shared with other envs and left alone
+	if string(ac.Templates[0].Body) != `{}` {
+		t.Errorf("wrong template: %s", ac.Templates[0].Body)
+	}
+
+	if revs, _ = ac.Revisions(); len(revs) != 3 || revs[2].Message != "rollback to 1" {
+		t.Fatalf("rollback not recorded: %+v", revs)
+	}
+
+	if err = ac.Rollback(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if ac, err = NewAppConfigFromName("revs-0.1.0-dev", be); err != nil {
+		t.Fatal(err)
+	}
+	if string(ac.Templates[0].Body) != `{"k1": "${k1}"}` {
+		t.Errorf("wrong template: %s", ac.Templates[0].Body)
+	}
+
+	if err = ac.Rollback(10, false); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func Test_AppConfig_NextRevision(t *testing.T) {
+	be := testDriver.be
+	defer be.DeleteMap(revisionsDir + "/revcas/")
+
+	a, _ := NewAppConfigFromName("revcas-0.1.0-dev", be)
+	b, _ := NewAppConfigFromName("revcas-0.1.0-dev", be)
+
+	for i, ac := range []*AppConfig{a, b, a} {
+		n, err := ac.nextRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i+1 {
+			t.Fatalf("wrong revision: have %d want %d", n, i+1)
+		}
+	}
+
+	// a head changed behind the back of the commit is not overwritten
+	ok, err := be.CompareAndSet(a.revisionPrefix()+"head", []byte("2"), []byte("9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("stale head should not be swapped")
+	}
+}
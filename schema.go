@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key the schema of a version is stored under i.e. <name>/<version>/.schema
+const schemaKey = ".schema"
+
+// Key types
+const (
+	TypeString   = "string"
+	TypeInt      = "int"
+	TypeBool     = "bool"
+	TypeURL      = "url"
+	TypeDuration = "duration"
+	TypeEnum     = "enum"
+	TypeRegex    = "regex"
+)
+
+// Schema declares the type of the keys of a version.  Keys not part of the
+// schema are not validated.
+type Schema map[string]*KeySchema
+
+type KeySchema struct {
+	Type        string `json:"type,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Allowed values of an enum
+	Values []string `json:"values,omitempty"`
+	// Pattern values of a regex type must match
+	Pattern string `json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Parse and check a schema given as json e.g.
+// {"db/port": {"type": "int", "required": true}}
+func ParseSchema(b []byte) (Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+
+	for k, ks := range s {
+		if ks == nil {
+			return nil, fmt.Errorf("invalid schema: '%s' is empty", k)
+		}
+
+		switch ks.Type {
+		case "", TypeString, TypeInt, TypeBool, TypeURL, TypeDuration:
+
+		case TypeEnum:
+			if len(ks.Values) == 0 {
+				return nil, fmt.Errorf("invalid schema: '%s' enum values required", k)
+			}
+
+		case TypeRegex:
+			var err error
+			if ks.re, err = regexp.Compile(ks.Pattern); err != nil {
+				return nil, fmt.Errorf("invalid schema: '%s' %v", k, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("invalid schema: '%s' unknown type '%s'", k, ks.Type)
+		}
+	}
+
+	return s, nil
+}
+
+// Validate a single value against the type of the key
+func (ks *KeySchema) Validate(v []byte) error {
+	val := string(v)
+
+	switch ks.Type {
+	case TypeInt:
+		if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return fmt.Errorf("not an int: '%s'", val)
+		}
+
+	case TypeBool:
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("not a bool: '%s'", val)
+		}
+
+	case TypeURL:
+		if u, err := url.Parse(val); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("not a url: '%s'", val)
+		}
+
+	case TypeDuration:
+		if _, err := time.ParseDuration(val); err != nil {
+			return fmt.Errorf("not a duration: '%s'", val)
+		}
+
+	case TypeEnum:
+		for _, ev := range ks.Values {
+			if ev == val {
+				return nil
+			}
+		}
+		return fmt.Errorf("not one of %s: '%s'", strings.Join(ks.Values, ","), val)
+
+	case TypeRegex:
+		if !ks.re.MatchString(val) {
+			return fmt.Errorf("does not match %s: '%s'", ks.Pattern, val)
+		}
+
+	}
+
+	return nil
+}
+
+// Validate a value of a key.  Keys without a value or not part of the schema
+// are always valid.
+func (s Schema) ValidateKey(k string, v []byte) error {
+	ks, ok := s[k]
+	if !ok || len(v) == 0 {
+		return nil
+	}
+	if err := ks.Validate(v); err != nil {
+		return fmt.Errorf("%s: %v", k, err)
+	}
+	return nil
+}
+
+// Validate all keys making sure required keys have a value.  All violations
+// are returned as a single error.
+func (s Schema) Validate(keys ConfigKeys) error {
+	errs := []string{}
+	for _, k := range s.Keys() {
+		if v := keys[k]; len(v) == 0 {
+			if s[k].Required {
+				errs = append(errs, k+": required")
+			}
+		} else if err := s.ValidateKey(k, v); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("schema violation: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Keys of the schema in sorted order
+func (s Schema) Keys() []string {
+	out := make([]string, 0, len(s))
+	for k := range s {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testSchema = `{
+	"db/port": {"type": "int", "required": true},
+	"db/ssl": {"type": "bool"},
+	"db/url": {"type": "url"},
+	"db/timeout": {"type": "duration"},
+	"log/level": {"type": "enum", "values": ["debug", "info"]},
+	"db/user": {"type": "regex", "pattern": "^[a-z_]+$"},
+	"db/name": {"description": "Database name"}
+}`
+
+func Test_Schema(t *testing.T) {
+	s, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := ConfigKeys{
+		"db/port":    []byte("5432"),
+		"db/ssl":     []byte("true"),
+		"db/url":     []byte("postgres://127.0.0.1:5432"),
+		"db/timeout": []byte("5s"),
+		"log/level":  []byte("info"),
+		"db/user":    []byte("app_user"),
+		"db/name":    []byte("anything"),
+	}
+	if err = s.Validate(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := ConfigKeys{
+		"db/ssl":     []byte("maybe"),
+		"db/url":     []byte("127.0.0.1"),
+		"db/timeout": []byte("5"),
+		"log/level":  []byte("trace"),
+		"db/user":    []byte("App-User"),
+	}
+	err = s.Validate(invalid)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	for _, k := range []string{"db/port: required", "db/ssl", "db/url", "db/timeout", "log/level", "db/user"} {
+		if !strings.Contains(err.Error(), k) {
+			t.Errorf("%s missing from: %v", k, err)
+		}
+	}
+
+	for _, b := range []string{`{"k": {"type": "float"}}`, `{"k": {"type": "enum"}}`, `{"k": {"type": "regex", "pattern": "("}}`, `[]`} {
+		if _, err = ParseSchema([]byte(b)); err == nil {
+			t.Errorf("%s: should fail", b)
+		}
+	}
+}
+
+func Test_AppConfig_Set_Schema(t *testing.T) {
+	ac, _ := NewAppConfigFromName("schema-0.1.0-dev", nil)
+
+	err := ac.Set(map[string][]byte{
+		schemaKey:   []byte(testSchema),
+		"db/port":   []byte("abc"),
+		"log/level": []byte("info"),
+	})
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	if ac.Schema != nil || len(ac.Keys) != 0 {
+		t.Fatal("nothing should be set")
+	}
+
+	if err = ac.Set(map[string][]byte{schemaKey: []byte(testSchema), "shared/version/db/port": []byte("5432")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ac.Set(map[string][]byte{"shared/app/db/port": []byte("abc")}); err == nil {
+		t.Fatal("should fail for shared keys")
+	}
+}
+
+func Test_AppConfig_Commit_StaleSchema(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("schema")
+
+	dev, _ := NewAppConfigFromName("schema-0.1.0-dev", ve.be)
+	dev.Set(map[string][]byte{schemaKey: []byte(`{"db/port": {"type": "int"}}`), "db/port": []byte("5432")})
+	if err := dev.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	prod, _ := NewAppConfigFromName("schema-0.1.0-prod", ve.be)
+	dev.Set(map[string][]byte{schemaKey: []byte(`{"db/port": {"type": "int", "required": true}}`)})
+	if err := dev.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a commit from a copy loaded before the change must not revert it
+	prod.Set(map[string][]byte{"db/port": []byte("5433")})
+	if err := prod.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := ve.Get("schema-0.1.0-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks := ac.Schema["db/port"]; ks == nil || !ks.Required {
+		t.Fatalf("schema reverted: %+v", ac.Schema)
+	}
+}
@@ -10,6 +10,10 @@ type Template struct {
 	Name string `json:"name"`
 	Body []byte `json:"body"`
 	Sha1 string `json:"sha1"`
+	// Static files are stored and written verbatim i.e. never rendered
+	Static bool `json:"static,omitempty"`
+	// Env the template belongs to when overriding the version template
+	Env string `json:"env,omitempty"`
 
 	rendered []byte
 }
@@ -17,12 +21,25 @@ type Template struct {
 func NewTemplateFromKey(key string) *Template {
 	pp := strings.Split(key, "/")
 	if len(pp) > 1 {
-		return &Template{Name: pp[1]}
+		return &Template{Name: pp[1], Static: pp[0] == "files"}
 	}
 
 	return nil
 }
 
+// Backend key the template body is stored under relative to the version
+func (t *Template) Key() string {
+	key := "templates/" + t.Name
+	if t.Static {
+		key = "files/" + t.Name
+	}
+
+	if t.Env != "" {
+		return t.Env + "/" + key
+	}
+	return key
+}
+
 func (t *Template) SetBody(b []byte) {
 	t.Body = b
 	t.rendered = b
@@ -32,7 +49,26 @@ func (t *Template) SetBody(b []byte) {
 	return
 }
 
+// Key as provided on the command line e.g. template:<name> or
+// env:file:<name>
+func (t *Template) optionKey() string {
+	key := "template:" + t.Name
+	if t.Static {
+		key = "file:" + t.Name
+	}
+
+	if t.Env != "" {
+		return ScopeEnv + ":" + key
+	}
+	return key
+}
+
 func (t *Template) Render(m map[string]string) ([]byte, error) {
+	if t.Static {
+		t.rendered = t.Body
+		return t.Body, nil
+	}
+
 	out := make([]byte, 0)
 
 	sm := -1
@@ -81,6 +117,9 @@ func (t *Template) Keys() (map[string]bool, error) {
 	}
 
 	tkeys := map[string]bool{}
+	if t.Static {
+		return tkeys, nil
+	}
 
 	sm := -1
 	var i int
@@ -108,6 +147,9 @@ func (t *Template) Keys() (map[string]bool, error) {
 
 // Validate curly braces
 func (t *Template) Validate() error {
+	if t.Static {
+		return nil
+	}
 	return validate(t.Body)
 }
 
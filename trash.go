@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Top level directory of soft deleted volumes i.e. .trash/<volume>/<id>
+const trashDir = ".trash"
+
+// TrashEntry is a soft deleted volume that can be restored until it expires
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Volume  string    `json:"volume"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+	// Volume archive (see Archive)
+	Archive json.RawMessage `json:"archive"`
+}
+
+func (e *TrashEntry) key() string {
+	return trashDir + "/" + e.Volume + "/" + e.ID
+}
+
+// Move the volume to the trash where it is kept for ttl.  The volume is
+// destroyed once it has been stored.  If destroying it fails while its keys are
+// still in place the entry is dropped again so the volume is not left both
+// live and trashed.
+func (a *AppConfig) Trash(ttl time.Duration) (*TrashEntry, error) {
+	if err := a.checkLock(); err != nil {
+		return nil, err
+	}
+
+	ar, err := NewArchive(a).Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	e := &TrashEntry{
+		ID:      fmt.Sprintf("%020d", now.UnixNano()),
+		Volume:  a.QualifiedName(),
+		Deleted: now,
+		Expires: now.Add(ttl),
+		Archive: ar,
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	hasKeys := a.be.KeyExists(a.getOpaque(a.Env + "/"))
+	if err = a.be.SetMap(trashDir+"/"+e.Volume+"/", map[string][]byte{e.ID: b}); err != nil {
+		return nil, err
+	}
+
+	if err = a.Destroy(); err != nil {
+		if !hasKeys || a.be.KeyExists(a.getOpaque(a.Env+"/")) {
+			if derr := a.be.DeleteKeys("", []string{e.key()}); derr != nil {
+				a.log().Warn("dropping trash entry failed", "volume", e.Volume, "id", e.ID, "err", derr)
+			}
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// Entries in the trash oldest first
+func (ve *VolEtc) TrashEntries() ([]*TrashEntry, error) {
+	m, err := ve.be.GetMap(trashDir + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	out := []*TrashEntry{}
+	for k, v := range m {
+		var e TrashEntry
+		if err = json.Unmarshal(v, &e); err != nil {
+			return nil, fmt.Errorf("invalid trash entry '%s': %v", k, err)
+		}
+		out = append(out, &e)
+	}
+
+	sort.Sort(trashEntriesByID(out))
+	return out, nil
+}
+
+// Restore the most recently trashed copy of the volume.  The volume must not
+// exist.  App and version keys, templates and the schema shared with other
+// envs that changed since the volume was trashed are only overwritten if
+// shared is set, otherwise the restore is refused.
+func (ve *VolEtc) Restore(name string, shared bool) error {
+	if _, err := ve.Get(name); err == nil {
+		return fmt.Errorf("exists: '%s'", name)
+	}
+
+	entries, err := ve.TrashEntries()
+	if err != nil {
+		return err
+	}
+
+	var e *TrashEntry
+	for _, te := range entries {
+		if te.Volume == name {
+			e = te
+		}
+	}
+	if e == nil {
+		return fmt.Errorf("not in trash: '%s'", name)
+	}
+
+	ar, err := UnmarshalArchive(e.Archive, nil)
+	if err != nil {
+		return err
+	}
+	data, _, err := ar.Data(true)
+	if err != nil {
+		return err
+	}
+
+	vol, err := NewAppConfigFromName(name, ve.be)
+	if err != nil {
+		return err
+	}
+	vol.source = ve.source
+
+	if !shared {
+		if changed := vol.changedShared(data); len(changed) > 0 {
+			return fmt.Errorf("changed since trashed, restore with -shared to overwrite: %s", strings.Join(changed, ", "))
+		}
+	}
+
+	if err = vol.Set(data); err == nil {
+		err = vol.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	return ve.be.DeleteKeys("", []string{e.key()})
+}
+
+// Keys in the format of Set shared with other envs whose current value differs
+// from the one in data.  Keys that no longer exist are not considered changed.
+func (a *AppConfig) changedShared(data map[string][]byte) []string {
+	cur := map[string][]byte{}
+	for k, v := range a.snapshot() {
+		if sk, err := optionStorageKey(k); err == nil {
+			cur[sk] = v
+		}
+	}
+
+	out := []string{}
+	for k, v := range data {
+		if cv, ok := cur[k]; ok && sharedScope(k) != "" && !bytes.Equal(cv, v) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Permanently delete trash entries that have expired by now.  It returns the
+// number of entries deleted.
+func (ve *VolEtc) PurgeTrash(now time.Time) (int, error) {
+	entries, err := ve.TrashEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		if !now.After(e.Expires) {
+			continue
+		}
+		if err = ve.be.DeleteKeys("", []string{e.key()}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+type trashEntriesByID []*TrashEntry
+
+func (t trashEntriesByID) Len() int           { return len(t) }
+func (t trashEntriesByID) Less(i, j int) bool { return t[i].ID < t[j].ID }
+func (t trashEntriesByID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// Driver removal policies
+const (
+	// Keep the data in the backend and only release the volume on the node
+	RemoveRetain = "retain"
+	// Move the volume to the trash
+	RemoveTrash = "trash"
+	// Destroy the volume data
+	RemoveDestroy = "destroy"
+)
+
+func parseRemovePolicy(s string) (string, error) {
+	switch p := strings.ToLower(s); p {
+	case RemoveRetain, RemoveTrash, RemoveDestroy:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid remove policy: '%s'", s)
+}
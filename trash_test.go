@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_VolumeDriver_RemovePolicy(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("trashed")
+	defer func() { testDriver.cfg.RemovePolicy = RemoveRetain }()
+
+	name := "trashed-0.1.0-dev"
+	ac, _ := NewAppConfigFromName(name, ve.be)
+	ac.Set(map[string][]byte{"db/host": []byte("127.0.0.1"), "templates/config.json": []byte(`{"host": "${db/host}"}`)})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// retain leaves the data in place
+	testDriver.cfg.RemovePolicy = RemoveRetain
+	if resp := testDriver.Remove(volume.Request{Name: name}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if _, err := ve.Get(name); err != nil {
+		t.Fatal("should be retained")
+	}
+
+	testDriver.cfg.RemovePolicy = RemoveTrash
+	if resp := testDriver.Remove(volume.Request{Name: name}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if _, err := ve.Get(name); err == nil {
+		t.Fatal("should be removed")
+	}
+
+	entries, err := ve.TrashEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Volume != name {
+		t.Fatalf("not in trash: %+v", entries)
+	}
+
+	if err = ve.Restore(name, false); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := ve.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(vol.Keys["db/host"]) != "127.0.0.1" {
+		t.Errorf("not restored: %+v", vol.Keys.ToString())
+	}
+	if err = ve.Restore(name, false); err == nil {
+		t.Error("should fail for existing volume")
+	}
+
+	// expired entries are purged
+	if _, err = vol.Trash(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := ve.PurgeTrash(time.Now()); n != 0 {
+		t.Error("should not be purged yet")
+	}
+	if n, _ := ve.PurgeTrash(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Error("should be purged")
+	}
+	if err = ve.Restore(name, false); err == nil {
+		t.Error("should fail after purge")
+	}
+
+	if _, err = parseRemovePolicy("keep"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+type noDeleteBackend struct{ Backend }
+
+func (noDeleteBackend) DeleteMap(string) error {
+	return fmt.Errorf("connection refused")
+}
+
+func Test_AppConfig_Trash_Failed(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("trashfail")
+
+	name := "trashfail-0.1.0-dev"
+	ac, _ := NewAppConfigFromName(name, noDeleteBackend{ve.be})
+	ac.Set(map[string][]byte{"db/host": []byte("127.0.0.1")})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ac.Trash(time.Hour); err == nil {
+		t.Fatal("should fail")
+	}
+	if _, err := ve.Get(name); err != nil {
+		t.Fatal("should still exist")
+	}
+	entries, _ := ve.TrashEntries()
+	for _, e := range entries {
+		if e.Volume == name {
+			t.Fatal("should not be in trash")
+		}
+	}
+}
+
+func Test_VolEtc_Restore_Shared(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+	defer ve.RemoveApp("restored")
+
+	name := "restored-0.1.0-dev"
+	for _, n := range []string{name, "restored-0.1.0-prod"} {
+		ac, _ := NewAppConfigFromName(n, ve.be)
+		ac.Set(map[string][]byte{"db/host": []byte("127.0.0.1"), "shared/version/db/port": []byte("5432")})
+		if err := ac.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ac, _ := ve.Get(name)
+	if _, err := ac.Trash(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer ve.be.DeleteMap(trashDir + "/" + name + "/")
+
+	prod, _ := ve.Get("restored-0.1.0-prod")
+	prod.Set(map[string][]byte{"shared/version/db/port": []byte("5433")})
+	if err := prod.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ve.Restore(name, false); err == nil {
+		t.Fatal("should fail when shared keys changed")
+	}
+	if err := ve.Restore(name, true); err != nil {
+		t.Fatal(err)
+	}
+	if vol, _ := ve.Get("restored-0.1.0-prod"); string(vol.VersionKeys["db/port"]) != "5432" {
+		t.Errorf("should be overwritten: %s", vol.VersionKeys["db/port"])
+	}
+}
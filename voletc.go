@@ -2,11 +2,16 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
 type VolEtc struct {
 	be Backend
+	// Where changes are made from e.g. cli or docker
+	source string
+	// Logger of the docker request the volumes are loaded for if any
+	lg *Logger
 }
 
 func (ve *VolEtc) Get(name string) (*AppConfig, error) {
@@ -14,6 +19,7 @@ func (ve *VolEtc) Get(name string) (*AppConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	acfg.source, acfg.lg = ve.source, ve.lg
 	// doesn't really exist ???
 	//if !acfg.HasMappedKeys() {
 	if !acfg.Exists() {
@@ -25,21 +31,26 @@ func (ve *VolEtc) Get(name string) (*AppConfig, error) {
 
 func (ve *VolEtc) List() (map[string]*AppConfig, error) {
 
-	mp, err := ve.be.GetMap("")
+	keys, err := ve.appKeys("")
 	if err != nil {
 		return nil, err
 	}
 
 	out := map[string]*AppConfig{}
+	seen := map[string]bool{}
 
-	for k, _ := range mp {
+	for _, k := range keys {
 		pp := strings.Split(k, "/")
-		// TODO: Support app and version without environment
-		// this would be needed to check for templates but no keys
-		if pp[2] == "templates" {
+		// Versions without an environment are not volumes (see Tree)
+		if len(pp) < 3 || strings.HasPrefix(pp[0], ".") || strings.HasPrefix(pp[1], ".") ||
+			strings.HasPrefix(pp[2], ".") || reservedVersions[pp[1]] || reservedEnvs[pp[2]] {
 			continue
 		}
-		name := fmt.Sprintf("%s-%s-%s", pp[0], pp[1], pp[2])
+		name := volumeNaming.Format(pp[0], pp[1], pp[2])
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
 
 		acfg, err := NewAppConfigFromName(name, ve.be)
 		if err != nil {
@@ -56,3 +67,297 @@ func (ve *VolEtc) List() (map[string]*AppConfig, error) {
 
 	return out, nil
 }
+
+// Names of the keys of the app or of all apps if name is empty.  The apps are
+// looked up first so the revisions, audit stream and trash stored alongside
+// them are never listed.
+func (ve *VolEtc) appKeys(name string) ([]string, error) {
+	if name != "" {
+		return ve.be.Keys(name+"/", "")
+	}
+
+	apps, err := ve.be.Keys("", "/")
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, app := range apps {
+		if strings.HasPrefix(app, ".") || !strings.HasSuffix(app, "/") {
+			continue
+		}
+		keys, err := ve.be.Keys(app, "")
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, keys...)
+	}
+	return out, nil
+}
+
+// AppTree is an app along with its versions and their environments
+type AppTree struct {
+	Name string
+	// Number of keys shared by all versions
+	SharedKeys int
+	Versions   []*VersionTree
+}
+
+type VersionTree struct {
+	Version string
+	Envs    []string
+	// Number of templates and files
+	Templates  int
+	SharedKeys int
+}
+
+// A version without environments only holds templates and shared keys that
+// are not used by any volume
+func (vt *VersionTree) Orphaned() bool {
+	return len(vt.Envs) == 0
+}
+
+// Tree of all apps, versions and environments including versions without any
+// environments.  If name is provided only that app is returned.
+func (ve *VolEtc) Tree(name string) ([]*AppTree, error) {
+	keys, err := ve.appKeys(name)
+	if err != nil {
+		return nil, err
+	}
+
+	apps := map[string]*AppTree{}
+	versions := map[string]*VersionTree{}
+	envs := map[string]bool{}
+
+	for _, k := range keys {
+		pp := strings.Split(k, "/")
+		if len(pp) < 2 || strings.HasPrefix(pp[0], ".") || (name != "" && pp[0] != name) {
+			continue
+		}
+
+		app, ok := apps[pp[0]]
+		if !ok {
+			app = &AppTree{Name: pp[0], Versions: []*VersionTree{}}
+			apps[pp[0]] = app
+		}
+
+		if reservedVersions[pp[1]] {
+			app.SharedKeys++
+			continue
+		}
+		if len(pp) < 3 || strings.HasPrefix(pp[1], ".") {
+			continue
+		}
+
+		vt, ok := versions[pp[0]+"/"+pp[1]]
+		if !ok {
+			vt = &VersionTree{Version: pp[1], Envs: []string{}}
+			versions[pp[0]+"/"+pp[1]] = vt
+			app.Versions = append(app.Versions, vt)
+		}
+
+		switch {
+		case pp[2] == "templates" || pp[2] == "files":
+			vt.Templates++
+		case pp[2] == sharedDir:
+			vt.SharedKeys++
+		case strings.HasPrefix(pp[2], "."):
+		case !envs[pp[0]+"/"+pp[1]+"/"+pp[2]]:
+			envs[pp[0]+"/"+pp[1]+"/"+pp[2]] = true
+			vt.Envs = append(vt.Envs, pp[2])
+		}
+	}
+
+	out := make([]*AppTree, 0, len(apps))
+	for _, app := range apps {
+		sort.Sort(versionTreesByVersion(app.Versions))
+		for _, vt := range app.Versions {
+			sort.Strings(vt.Envs)
+		}
+		out = append(out, app)
+	}
+	sort.Sort(appTreesByName(out))
+
+	return out, nil
+}
+
+// Remove a version of an app i.e. all of its environments, templates, shared
+// keys, revisions and the aliases pointing at it.  Environments are destroyed
+// individually so their removal is audited.
+func (ve *VolEtc) RemoveVersion(name, version string) error {
+	vt, err := ve.versionTree(name, version)
+	if err != nil {
+		return err
+	}
+
+	// Make sure none of the environments are locked before removing any
+	if err = ve.checkLocks(name, vt); err != nil {
+		return err
+	}
+
+	// Aliases would resolve to volumes that no longer exist
+	aliases, err := ve.versionAliases(name, version)
+	if err != nil {
+		return err
+	}
+	if len(aliases) > 0 {
+		if err = ve.be.DeleteKeys(aliasPrefix(name), aliases); err != nil {
+			return err
+		}
+	}
+
+	for _, env := range vt.Envs {
+		vol, err := ve.Get(volumeNaming.Format(name, version, env))
+		if err != nil {
+			return err
+		}
+		if err = vol.Destroy(); err != nil {
+			return err
+		}
+	}
+
+	return ve.deleteVersion(name, version)
+}
+
+// Remove an app along with all of its versions and shared keys
+func (ve *VolEtc) RemoveApp(name string) error {
+	tree, err := ve.Tree(name)
+	if err != nil {
+		return err
+	}
+	if len(tree) == 0 {
+		return fmt.Errorf("not found: '%s'", name)
+	}
+
+	for _, vt := range tree[0].Versions {
+		if err = ve.checkLocks(name, vt); err != nil {
+			return err
+		}
+	}
+
+	for _, vt := range tree[0].Versions {
+		if err = ve.RemoveVersion(name, vt.Version); err != nil {
+			return err
+		}
+	}
+
+	return ve.be.DeleteMap(name + "/")
+}
+
+// Remove versions without environments that no alias points at.  Apps left
+// without any environment are only removed if shared is set as they still hold
+// the keys, aliases and metadata shared by their versions.  It returns the
+// removed versions as <name>-<version> and apps as <name>.  If dryrun is set
+// nothing is removed.
+func (ve *VolEtc) GC(dryrun, shared bool) ([]string, error) {
+	tree, err := ve.Tree("")
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, app := range tree {
+		remaining := 0
+		for _, vt := range app.Versions {
+			if !vt.Orphaned() {
+				remaining++
+				continue
+			}
+
+			aliases, err := ve.versionAliases(app.Name, vt.Version)
+			if err != nil {
+				return nil, err
+			}
+			if len(aliases) > 0 {
+				remaining++
+				continue
+			}
+
+			if !dryrun {
+				if err = ve.deleteVersion(app.Name, vt.Version); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, app.Name+"-"+vt.Version)
+		}
+
+		if remaining == 0 && shared {
+			if !dryrun {
+				if err = ve.be.DeleteMap(app.Name + "/"); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, app.Name)
+		}
+	}
+
+	return out, nil
+}
+
+func (ve *VolEtc) versionTree(name, version string) (*VersionTree, error) {
+	tree, err := ve.Tree(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tree) > 0 {
+		for _, vt := range tree[0].Versions {
+			if vt.Version == version {
+				return vt, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("not found: '%s-%s'", name, version)
+}
+
+// Aliases of the app pointing at the version
+func (ve *VolEtc) versionAliases(name, version string) ([]string, error) {
+	aliases, err := ve.Aliases(name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for alias, v := range aliases {
+		if v == version {
+			out = append(out, alias)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Error if any of the environments of the version are locked
+func (ve *VolEtc) checkLocks(name string, vt *VersionTree) error {
+	for _, env := range vt.Envs {
+		vol, err := NewAppConfigFromName(volumeNaming.Format(name, vt.Version, env), nil)
+		if err != nil {
+			return err
+		}
+		vol.be = ve.be
+		if err = vol.checkLock(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete all data of a version including its revisions
+func (ve *VolEtc) deleteVersion(name, version string) error {
+	if err := ve.be.DeleteMap(name + "/" + version + "/"); err != nil {
+		return err
+	}
+	return ve.be.DeleteMap(revisionsDir + "/" + name + "/" + version + "/")
+}
+
+type appTreesByName []*AppTree
+
+func (a appTreesByName) Len() int           { return len(a) }
+func (a appTreesByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a appTreesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type versionTreesByVersion []*VersionTree
+
+func (v versionTreesByVersion) Len() int           { return len(v) }
+func (v versionTreesByVersion) Less(i, j int) bool { return v[i].Version < v[j].Version }
+func (v versionTreesByVersion) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
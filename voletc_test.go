@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_VolEtc_Lifecycle(t *testing.T) {
+	ve := &VolEtc{be: testDriver.be, source: "cli"}
+
+	for _, name := range []string{"lifecycle-0.1.0-dev", "lifecycle-0.1.0-prod", "lifecycle-0.2.0-dev"} {
+		ac, err := NewAppConfigFromName(name, ve.be)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.Set(map[string][]byte{
+			"db/host":               []byte("127.0.0.1"),
+			"shared/app/flag":       []byte("true"),
+			"templates/config.json": []byte(`{"host": "${db/host}"}`),
+		})
+		if err = ac.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leave 0.2.0 with only its templates
+	vol, err := ve.Get("lifecycle-0.2.0-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := ve.Tree("lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 1 || len(tree[0].Versions) != 2 || tree[0].SharedKeys != 1 {
+		t.Fatalf("wrong tree: %+v", tree)
+	}
+	if v := tree[0].Versions[0]; v.Version != "0.1.0" || len(v.Envs) != 2 || v.Envs[0] != "dev" || v.Templates != 1 {
+		t.Errorf("wrong version: %+v", v)
+	}
+	if v := tree[0].Versions[1]; !v.Orphaned() {
+		t.Errorf("should be orphaned: %+v", v)
+	}
+
+	// versions aliases point at are kept
+	if err = ve.SetAlias("lifecycle", "next", "0.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := ve.GC(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("aliased version should be kept: %v", removed)
+	}
+	if err = ve.RemoveAlias("lifecycle", "next"); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err = ve.GC(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "lifecycle-0.2.0" {
+		t.Errorf("wrong gc: %v", removed)
+	}
+
+	if err = ve.RemoveVersion("lifecycle", "0.2.0"); err == nil {
+		t.Error("should fail")
+	}
+	if err = ve.SetAlias("lifecycle", "stable", "0.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ve.RemoveVersion("lifecycle", "0.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ve.Get("lifecycle-0.1.0-prod"); err == nil {
+		t.Error("should be removed")
+	}
+	if aliases, _ := ve.Aliases("lifecycle"); len(aliases) != 0 {
+		t.Errorf("aliases of the version should be removed: %v", aliases)
+	}
+
+	// the app keys are only collected with shared
+	if removed, err = ve.GC(false, false); err != nil || strings.Contains(" "+strings.Join(removed, " ")+" ", " lifecycle ") {
+		t.Errorf("app should be kept: %v %v", removed, err)
+	}
+	if removed, err = ve.GC(true, true); err != nil || !strings.Contains(" "+strings.Join(removed, " ")+" ", " lifecycle ") {
+		t.Errorf("app should be collected with shared: %v %v", removed, err)
+	}
+
+	if err = ve.RemoveApp("lifecycle"); err != nil {
+		t.Fatal(err)
+	}
+	if tree, _ = ve.Tree("lifecycle"); len(tree) != 0 {
+		t.Errorf("should be removed: %+v", tree[0])
+	}
+}
+
+// scanBackend records the prefixes read by GetMap
+type scanBackend struct {
+	Backend
+	read []string
+}
+
+func (sb *scanBackend) GetMap(prefix string) (map[string][]byte, error) {
+	sb.read = append(sb.read, prefix)
+	return sb.Backend.GetMap(prefix)
+}
+
+func Test_VolEtc_List_Bookkeeping(t *testing.T) {
+	sb := &scanBackend{Backend: testDriver.be}
+	ve := &VolEtc{be: sb, source: "cli"}
+	defer testDriver.be.DeleteMap("scan/")
+
+	ac, _ := NewAppConfigFromName("scan-0.1.0-dev", testDriver.be)
+	ac.Set(map[string][]byte{"k": []byte("v")})
+	if err := ac.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	vols, err := ve.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vols["scan-0.1.0-dev"]; !ok {
+		t.Fatal("volume not listed")
+	}
+	if _, err = ve.Tree(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// revisions, audit entries and trash are never read to find the apps
+	for _, p := range sb.read {
+		if p == "" || strings.HasPrefix(p, ".") {
+			t.Errorf("should not read '%s'", p)
+		}
+	}
+}